@@ -0,0 +1,134 @@
+// Package certs loads TLS certificates and CA pools from disk and picks up
+// rotated files without a restart.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader keeps a certificate and a CA pool loaded from disk and
+// re-reads them whenever one of the files changes, so rotated certificates
+// are picked up by new handshakes without a restart.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu      sync.Mutex
+	modTime time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+func NewReloader(certFile string, keyFile string, caFile string) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	err = r.load(modTime)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	var files []string
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func (r *Reloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *Reloader) load(modTime time.Time) error {
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		loaded, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("Failed to load key pair: %w", err)
+		}
+		cert = &loaded
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in %s", r.caFile)
+		}
+	}
+
+	r.cert = cert
+	r.pool = pool
+	r.modTime = modTime
+	return nil
+}
+
+// refresh reloads the files if they changed since the last load. A failed
+// reload keeps the previous material, since files are often rotated one at a
+// time and may be inconsistent for a moment.
+func (r *Reloader) refresh() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := r.latestModTime()
+	if err != nil {
+		slog.Error("Failed to stat TLS files", "error", err)
+		return
+	}
+	if !modTime.After(r.modTime) {
+		return
+	}
+
+	err = r.load(modTime)
+	if err != nil {
+		slog.Error("Failed to reload TLS files, keeping previous ones", "error", err)
+		return
+	}
+	slog.Info("Reloaded TLS files", "files", r.files())
+}
+
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.refresh()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert
+}
+
+func (r *Reloader) CAPool() *x509.CertPool {
+	r.refresh()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pool
+}
@@ -0,0 +1,147 @@
+// Package config loads the flags of a service from a YAML file, the
+// environment and the command line, and logs the result.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Load fills the flags of fs from, in increasing priority, their
+// defaults, the YAML config file, environment variables and args.
+// Environment variables carry the prefix of the service, so they do not
+// clash with generic ones such as PORT: with the prefix USER_SERVICE_, the
+// setting db-password is read from USER_SERVICE_DB_PASSWORD, or from the
+// file named by USER_SERVICE_DB_PASSWORD_FILE.
+func Load(fs *flag.FlagSet, envPrefix string, args []string) error {
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	fromArgs := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		fromArgs[f.Name] = true
+	})
+
+	configFile := fs.Lookup("config").Value.String()
+	if configFile == "" {
+		configFile = os.Getenv(envPrefix + "CONFIG_FILE")
+		fs.Set("config", configFile)
+	}
+	if configFile != "" {
+		err = loadConfigFile(fs, configFile, fromArgs)
+		if err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if fromArgs[f.Name] || f.Name == "config" {
+			return
+		}
+		name := envPrefix + envName(f.Name)
+		value, ok, err := lookupEnv(name)
+		if err == nil && ok {
+			err = fs.Set(f.Name, value)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func loadConfigFile(fs *flag.FlagSet, path string, fromArgs map[string]bool) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var settings map[string]interface{}
+	err = yaml.Unmarshal(content, &settings)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var errs []error
+	for name, value := range settings {
+		if fs.Lookup(name) == nil || name == "config" {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %s", path, name))
+			continue
+		}
+		if fromArgs[name] {
+			continue
+		}
+		err = fs.Set(name, yamlValue(value))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", path, name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// yamlValue turns a YAML scalar or list into the text the flag parses, lists
+// become comma-separated.
+func yamlValue(value interface{}) string {
+	list, ok := value.([]interface{})
+	if !ok {
+		return fmt.Sprint(value)
+	}
+	items := make([]string, 0, len(list))
+	for _, item := range list {
+		items = append(items, fmt.Sprint(item))
+	}
+	return strings.Join(items, ",")
+}
+
+func envName(flagName string) string {
+	return strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func lookupEnv(name string) (string, bool, error) {
+	file, ok := os.LookupEnv(name + "_FILE")
+	if ok {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", false, err
+		}
+		return strings.TrimRight(string(content), "\r\n"), true, nil
+	}
+	value, ok := os.LookupEnv(name)
+	return value, ok, nil
+}
+
+// Log logs the effective settings with the secret ones and passwords in
+// URLs redacted.
+func Log(fs *flag.FlagSet, secrets map[string]bool) {
+	var attrs []any
+	fs.VisitAll(func(f *flag.Flag) {
+		attrs = append(attrs, slog.String(f.Name, redactSetting(f.Value.String(), secrets[f.Name])))
+	})
+	slog.Info("Configuration", attrs...)
+}
+
+func redactSetting(value string, secret bool) string {
+	if value == "" {
+		return value
+	}
+	if secret {
+		return "[redacted]"
+	}
+	u, err := url.Parse(value)
+	if err == nil && u.User != nil {
+		_, hasPassword := u.User.Password()
+		if hasPassword {
+			return u.Redacted()
+		}
+	}
+	return value
+}
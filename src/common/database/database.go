@@ -0,0 +1,175 @@
+// Package database holds what the services do alike with their SQL
+// databases: pool settings, waiting for the server and retrying work that
+// failed transiently. It does not depend on a driver.
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+func (p PoolConfig) Apply(db *sql.DB) {
+	db.SetMaxOpenConns(p.MaxOpenConns)
+	db.SetMaxIdleConns(p.MaxIdleConns)
+	db.SetConnMaxLifetime(p.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+}
+
+// Backoff doubles the delay after every attempt up to Max. Delays are
+// jittered so replicas that failed together do not retry together.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.Initial
+	for i := 0; i < attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+	delay = min(delay, b.Max)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Sleep waits for d, or returns the error of ctx once it ends.
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Wait pings db with backoff until it answers or timeout passes.
+func Wait(ctx context.Context, db *sql.DB, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := Backoff{Initial: 100 * time.Millisecond, Max: 5 * time.Second}
+	for attempt := 0; ; attempt++ {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+
+		delay := backoff.Delay(attempt)
+		slog.Warn("Database is not reachable yet", "attempt", attempt+1, "retry_in", delay, "error", err)
+		if Sleep(ctx, delay) != nil {
+			return err
+		}
+	}
+}
+
+// RetryPolicy decides how often queries that failed transiently are
+// repeated. MaxAttempts includes the first attempt.
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     Backoff
+}
+
+// Policy is used by Retry, services set MaxAttempts from their config.
+var Policy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     Backoff{Initial: 50 * time.Millisecond, Max: time.Second},
+}
+
+// IsTransientError reports errors after which repeating the same work is
+// safe and may succeed: serialization failures and deadlocks, which roll the
+// transaction back, and broken connections the statement never reached. A
+// connection lost later may have applied the work, so it is not retried.
+// lib/pq and pgx errors both tell their SQLSTATE, pgx also whether anything
+// was sent at all.
+func IsTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var commitErr *CommitError
+	if errors.As(err, &commitErr) {
+		return false
+	}
+
+	var stateErr interface{ SQLState() string }
+	if errors.As(err, &stateErr) {
+		code := stateErr.SQLState()
+		return code == "40001" || code == "40P01"
+	}
+	var unsentErr interface{ SafeToRetry() bool }
+	if errors.As(err, &unsentErr) && unsentErr.SafeToRetry() {
+		return true
+	}
+	return errors.Is(err, driver.ErrBadConn)
+}
+
+// CommitError is returned when COMMIT fails. The transaction may have been
+// applied anyway, so it is never retried.
+type CommitError struct {
+	Err error
+}
+
+func (e *CommitError) Error() string {
+	return "commit: " + e.Err.Error()
+}
+
+func (e *CommitError) Unwrap() error {
+	return e.Err
+}
+
+// Retry runs fn until it succeeds, fails with an error that is not
+// transient, or Policy gives up. fn must be safe to repeat, which holds for
+// reads and for whole transactions.
+func Retry(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < Policy.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := Policy.Backoff.Delay(attempt - 1)
+			slog.WarnContext(ctx, "Retrying database operation", "attempt", attempt+1, "retry_in", delay, "error", err)
+			if Sleep(ctx, delay) != nil {
+				return err
+			}
+		}
+
+		err = fn()
+		if !IsTransientError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// RunInTx runs fn in a transaction, and again in a new one if it failed
+// transiently. fn must not have side effects outside of tx. A failed commit
+// is returned as a *CommitError.
+func RunInTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	return Retry(ctx, func() error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		err = fn(tx)
+		if err != nil {
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return &CommitError{Err: err}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+// unsentError stands for pgx errors raised before the query reached the
+// server.
+type unsentError struct{}
+
+func (unsentError) Error() string {
+	return "dial tcp: connection refused"
+}
+
+func (unsentError) SafeToRetry() bool {
+	return true
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"serialization failure", &pq.Error{Code: "40001"}, true},
+		{"deadlock", &pq.Error{Code: "40P01"}, true},
+		{"wrapped deadlock", fmt.Errorf("update: %w", &pq.Error{Code: "40P01"}), true},
+		{"unique violation", &pq.Error{Code: "23505"}, false},
+		{"connection exception", &pq.Error{Code: "08006"}, false},
+		{"pgx serialization failure", &pgconn.PgError{Code: "40001"}, true},
+		{"pgx deadlock", fmt.Errorf("update: %w", &pgconn.PgError{Code: "40P01"}), true},
+		{"pgx unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"pgx admin shutdown", &pgconn.PgError{Code: "57P01"}, false},
+		{"never sent", unsentError{}, true},
+		{"wrapped never sent", fmt.Errorf("query: %w", unsentError{}), true},
+		{"bad connection", driver.ErrBadConn, true},
+		{"network error", &net.OpError{Op: "read", Err: io.ErrUnexpectedEOF}, false},
+		{"connection closed", io.EOF, false},
+		{"canceled", context.Canceled, false},
+		{"deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), false},
+		{"failed commit", &CommitError{Err: &pq.Error{Code: "40001"}}, false},
+		{"failed commit on bad connection", &CommitError{Err: driver.ErrBadConn}, false},
+		{"failed commit never sent", &CommitError{Err: unsentError{}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := IsTransientError(test.err)
+			if got != test.want {
+				t.Errorf("IsTransientError(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{Initial: 100 * time.Millisecond, Max: time.Second}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{100, time.Second},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.attempt), func(t *testing.T) {
+			// Delays are jittered between half and all of the full delay.
+			for i := 0; i < 100; i++ {
+				got := backoff.Delay(test.attempt)
+				if got < test.want/2 || got > test.want {
+					t.Fatalf("Delay(%d) = %s, want between %s and %s", test.attempt, got, test.want/2, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	saved := Policy
+	defer func() { Policy = saved }()
+	Policy = RetryPolicy{MaxAttempts: 3, Backoff: Backoff{Initial: time.Millisecond, Max: time.Millisecond}}
+
+	tests := []struct {
+		name     string
+		errs     []error
+		wantErr  error
+		wantRuns int
+	}{
+		{"success", []error{nil}, nil, 1},
+		{"transient then success", []error{driver.ErrBadConn, nil}, nil, 2},
+		{"gives up", []error{driver.ErrBadConn, driver.ErrBadConn, driver.ErrBadConn}, driver.ErrBadConn, 3},
+		{"permanent", []error{io.EOF}, io.EOF, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runs := 0
+			err := Retry(context.Background(), func() error {
+				runs++
+				return test.errs[runs-1]
+			})
+			if err != test.wantErr || runs != test.wantRuns {
+				t.Errorf("Retry = %v after %d runs, want %v after %d", err, runs, test.wantErr, test.wantRuns)
+			}
+		})
+	}
+}
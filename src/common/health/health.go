@@ -0,0 +1,87 @@
+// Package health runs the readiness checks of a service and serves the
+// liveness and readiness probes.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const checkTimeout = 2 * time.Second
+
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Run runs checks in parallel. The report is unavailable if any fails or
+// does not answer in time.
+func Run(ctx context.Context, checks []Check) Report {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	report := Report{
+		Status: "ok",
+		Checks: map[string]string{},
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+			result := "ok"
+			err := check.Check(ctx)
+			if err != nil {
+				result = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[check.Name] = result
+			if err != nil {
+				report.Status = "unavailable"
+			}
+		}(check)
+	}
+	wg.Wait()
+	return report
+}
+
+// KafkaCheck reports whether the broker at kafkaURL accepts connections.
+func KafkaCheck(kafkaURL string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		conn, err := kafka.DialContext(ctx, "tcp", kafkaURL)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// Healthz only tells that the process is able to answer.
+func Healthz(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// Readyz answers with the report of checks, and 503 if any fails.
+func Readyz(checks []Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		report := Run(req.Context(), checks)
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,109 @@
+// Package logging sets up slog and carries request IDs through HTTP, gRPC
+// and Kafka.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"regexp"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/trace"
+
+	"common/tracing"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+
+	// RequestIDMetadata carries the request ID in gRPC calls.
+	RequestIDMetadata = "x-request-id"
+)
+
+// Request IDs sent by clients are kept if they are short and harmless in
+// logs, anything else is replaced.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// ValidRequestID reports whether a request ID sent by a client can be kept.
+func ValidRequestID(requestId string) bool {
+	return requestIDPattern.MatchString(requestId)
+}
+
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Init makes slog, and the log package through it, write JSON lines to
+// stderr. Records logged with a context carry its request and trace ID.
+func Init(service string, level string) error {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		return err
+	}
+
+	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
+	slog.SetDefault(slog.New(contextHandler{handler}).With("service", service))
+	return nil
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	requestId := RequestIDFromContext(ctx)
+	if requestId != "" {
+		record.AddAttrs(slog.String("request_id", requestId))
+	}
+	spanContext := trace.SpanContextFromContext(ctx)
+	if spanContext.IsValid() {
+		record.AddAttrs(slog.String("trace_id", spanContext.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIDKey struct{}
+
+func WithRequestID(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestId)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIDKey{}).(string)
+	return requestId
+}
+
+// SetMessageRequestID passes the request ID of ctx on to the consumers of
+// msgs.
+func SetMessageRequestID(ctx context.Context, msgs []kafka.Message) {
+	requestId := RequestIDFromContext(ctx)
+	if requestId == "" {
+		return
+	}
+	for i := range msgs {
+		tracing.KafkaHeaders{Msg: &msgs[i]}.Set(RequestIDHeader, requestId)
+	}
+}
+
+// WithMessageRequestID continues the request that produced msg.
+func WithMessageRequestID(ctx context.Context, msg *kafka.Message) context.Context {
+	requestId := tracing.KafkaHeaders{Msg: msg}.Get(RequestIDHeader)
+	if requestId == "" {
+		return ctx
+	}
+	return WithRequestID(ctx, requestId)
+}
@@ -0,0 +1,141 @@
+// Package metrics holds the Prometheus metrics every service exports for
+// HTTP requests and Kafka, and the helpers that record them.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+
+	"common/logging"
+	"common/tracing"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time to serve HTTP requests by route template and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	kafkaProduced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_produced_messages_total",
+		Help: "Messages written to Kafka by topic.",
+	}, []string{"topic"})
+	kafkaProduceErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_produce_errors_total",
+		Help: "Failed Kafka writes by topic.",
+	}, []string{"topic"})
+	kafkaProduceDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kafka_produce_duration_seconds",
+		Help:    "Time until Kafka acknowledged a write, by topic.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"topic"})
+
+	kafkaConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_consumed_messages_total",
+		Help: "Messages read from Kafka by topic.",
+	}, []string{"topic"})
+	// KafkaConsumeErrors is counted by the consumers themselves, only they
+	// know the stage that failed.
+	KafkaConsumeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_consume_errors_total",
+		Help: "Messages that failed by topic and stage: read, decode or process.",
+	}, []string{"topic", "stage"})
+	kafkaConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kafka_consumer_lag",
+		Help: "Messages behind the end of the topic after the last read.",
+	}, []string{"topic"})
+)
+
+// HTTP records every routed request under its route template, so /post/1
+// and /post/2 end up in the same series.
+func HTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := RouteTemplate(req)
+		recorder := NewStatusRecorder(w)
+		start := time.Now()
+		next.ServeHTTP(recorder, req)
+
+		httpRequestDuration.WithLabelValues(route, req.Method).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, req.Method, strconv.Itoa(recorder.Status)).Inc()
+	})
+}
+
+// RouteTemplate returns the gorilla/mux template of the route req matched.
+func RouteTemplate(req *http.Request) string {
+	current := mux.CurrentRoute(req)
+	if current == nil {
+		return "unknown"
+	}
+	template, err := current.GetPathTemplate()
+	if err != nil {
+		return "unknown"
+	}
+	return template
+}
+
+// StatusRecorder remembers the status code of the response it passes on.
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status      int
+	wroteHeader bool
+}
+
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.Status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *StatusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+// WriteKafka writes messages to Kafka, records the outcome per topic and
+// passes the trace and request ID of ctx on in the message headers.
+func WriteKafka(ctx context.Context, writer *kafka.Writer, msgs ...kafka.Message) error {
+	logging.SetMessageRequestID(ctx, msgs)
+	ctx, span := tracing.StartKafkaPublish(ctx, writer.Topic, msgs)
+	err := WriteKafkaMessages(ctx, writer, msgs)
+	tracing.EndSpan(span, err)
+	return err
+}
+
+// WriteKafkaMessages writes msgs with the headers they already have and
+// records the outcome.
+func WriteKafkaMessages(ctx context.Context, writer *kafka.Writer, msgs []kafka.Message) error {
+	start := time.Now()
+	err := writer.WriteMessages(ctx, msgs...)
+	kafkaProduceDuration.WithLabelValues(writer.Topic).Observe(time.Since(start).Seconds())
+	if err != nil {
+		kafkaProduceErrors.WithLabelValues(writer.Topic).Inc()
+		return err
+	}
+	kafkaProduced.WithLabelValues(writer.Topic).Add(float64(len(msgs)))
+	return nil
+}
+
+// ObserveKafkaRead records a read message and the lag it left behind.
+func ObserveKafkaRead(reader *kafka.Reader) {
+	topic := reader.Config().Topic
+	kafkaConsumed.WithLabelValues(topic).Inc()
+	kafkaConsumerLag.WithLabelValues(topic).Set(float64(reader.Stats().Lag))
+}
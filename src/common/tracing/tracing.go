@@ -0,0 +1,144 @@
+// Package tracing sets up OpenTelemetry and carries traces through Kafka
+// messages.
+package tracing
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+
+	"github.com/XSAM/otelsql"
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is named after the service once Init ran.
+var tracer = otel.Tracer("common/tracing")
+
+// Init installs the global tracer provider and the W3C propagator.
+// The exporter is none, stdout or otlp; an empty OTLP endpoint falls back to
+// OTEL_EXPORTER_OTLP_ENDPOINT. The returned func flushes pending spans.
+func Init(ctx context.Context, serviceName string, exporter string, endpoint string) (func(context.Context) error, error) {
+	tracer = otel.Tracer(serviceName)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		spanExporter, err = stdouttrace.New()
+	case "otlp":
+		var options []otlptracegrpc.Option
+		if endpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpointURL(endpoint))
+		}
+		spanExporter, err = otlptracegrpc.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// TracedQueriesOnly drops spans of queries made outside of a trace, such as
+// schema setup and background sweeps, which would each start a trace of
+// their own.
+func TracedQueriesOnly(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+	return trace.SpanContextFromContext(ctx).IsValid()
+}
+
+// KafkaHeaders lets the propagator read and write Kafka message headers.
+type KafkaHeaders struct {
+	Msg *kafka.Message
+}
+
+func (h KafkaHeaders) Get(key string) string {
+	for _, header := range h.Msg.Headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func (h KafkaHeaders) Set(key string, value string) {
+	for i, header := range h.Msg.Headers {
+		if header.Key == key {
+			h.Msg.Headers[i].Value = []byte(value)
+			return
+		}
+	}
+	h.Msg.Headers = append(h.Msg.Headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (h KafkaHeaders) Keys() []string {
+	keys := make([]string, 0, len(h.Msg.Headers))
+	for _, header := range h.Msg.Headers {
+		keys = append(keys, header.Key)
+	}
+	return keys
+}
+
+// StartKafkaPublish starts a producer span and injects it into the headers of
+// msgs, so consumers continue the trace.
+func StartKafkaPublish(ctx context.Context, topic string, msgs []kafka.Message) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKafka,
+			semconv.MessagingDestinationName(topic),
+			semconv.MessagingBatchMessageCount(len(msgs)),
+		),
+	)
+	for i := range msgs {
+		otel.GetTextMapPropagator().Inject(ctx, KafkaHeaders{Msg: &msgs[i]})
+	}
+	return ctx, span
+}
+
+// StartKafkaProcess starts a consumer span that continues the trace carried
+// in the headers of msg.
+func StartKafkaProcess(ctx context.Context, msg *kafka.Message) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, KafkaHeaders{Msg: msg})
+	return tracer.Start(ctx, msg.Topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKafka,
+			semconv.MessagingDestinationName(msg.Topic),
+			semconv.MessagingKafkaDestinationPartition(msg.Partition),
+			semconv.MessagingKafkaMessageOffset(int(msg.Offset)),
+		),
+	)
+}
+
+// EndSpan ends span and marks it failed if err is not nil.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	ConfigFile string
+
+	Port                int
+	HTTPPort            int
+	HealthCheckInterval time.Duration
+
+	DBHost     string
+	DBPort     int
+	DBName     string
+	DBUsername string
+	DBPassword string
+
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+	DBConnMaxIdleTime time.Duration
+	DBConnectTimeout  time.Duration
+	DBRetryAttempts   int
+
+	KafkaURL           string
+	DeletedAuthorPosts string
+
+	PostRetention time.Duration
+	PurgeInterval time.Duration
+
+	TLSCert           string
+	TLSKey            string
+	TLSClientCA       string
+	TLSAllowedClients string
+
+	LogLevel        string
+	TracingExporter string
+	OTLPEndpoint    string
+	ShutdownTimeout time.Duration
+}
+
+// envPrefix starts the environment variables of the settings, e.g.
+// POST_SERVICE_KAFKA_URL.
+const envPrefix = "POST_SERVICE_"
+
+// secretSettings are never printed. Like every setting they can be read from
+// a file named by the POST_SERVICE_<NAME>_FILE environment variable.
+var secretSettings = map[string]bool{
+	"db-password": true,
+}
+
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "config", "", "YAML `file` with settings named like the flags, POST_SERVICE_CONFIG_FILE is used if empty")
+
+	fs.IntVar(&c.Port, "port", 8090, "gRPC server port")
+	fs.IntVar(&c.HTTPPort, "http-port", 8091, "port of the HTTP server with /healthz, /readyz and /metrics, never publish it")
+	fs.DurationVar(&c.HealthCheckInterval, "health-check-interval", 5*time.Second, "how often dependencies are checked for the gRPC health status")
+
+	fs.StringVar(&c.DBHost, "db-host", "", "hostname of the database")
+	fs.IntVar(&c.DBPort, "db-port", 5433, "port of the database")
+	fs.StringVar(&c.DBName, "db-name", "", "database name")
+	fs.StringVar(&c.DBUsername, "db-username", "", "database user")
+	fs.StringVar(&c.DBPassword, "db-password", "", "database password, prefer POST_SERVICE_DB_PASSWORD_FILE")
+
+	fs.IntVar(&c.DBMaxOpenConns, "db-max-open-conns", 25, "most open database connections, 0 means unlimited")
+	fs.IntVar(&c.DBMaxIdleConns, "db-max-idle-conns", 10, "most idle database connections kept for reuse")
+	fs.DurationVar(&c.DBConnMaxLifetime, "db-conn-max-lifetime", 30*time.Minute, "how long a database connection is reused at most, 0 means forever")
+	fs.DurationVar(&c.DBConnMaxIdleTime, "db-conn-max-idle-time", 5*time.Minute, "how long a database connection may stay idle, 0 means forever")
+	fs.DurationVar(&c.DBConnectTimeout, "db-connect-timeout", 30*time.Second, "how long startup waits for the database")
+	fs.IntVar(&c.DBRetryAttempts, "db-retry-attempts", 3, "attempts for queries and transactions that fail with a transient error")
+
+	fs.StringVar(&c.KafkaURL, "kafka-url", "", "address of the Kafka")
+	fs.StringVar(&c.DeletedAuthorPosts, "deleted-author-posts", "anonymise", "what to do with posts of deleted users: anonymise or delete")
+
+	fs.DurationVar(&c.PostRetention, "post-retention", 30*24*time.Hour, "how long deleted posts can be restored before they are purged")
+	fs.DurationVar(&c.PurgeInterval, "purge-interval", time.Hour, "how often posts past their retention are purged")
+
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "path to server certificate `file`, enables TLS")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "path to server private key `file`")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", "", "path to CA `file` used to verify client certificates, enables mTLS")
+	fs.StringVar(&c.TLSAllowedClients, "tls-allowed-clients", "", "comma-separated SANs of clients allowed to connect, all verified clients if empty")
+
+	fs.StringVar(&c.LogLevel, "log-level", "info", "lowest level that is logged: debug, info, warn or error")
+	fs.StringVar(&c.TracingExporter, "tracing-exporter", "none", "where spans are sent: none, stdout or otlp")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", "", "URL of the OTLP gRPC collector, e.g. http://jaeger:4317, defaults to OTEL_EXPORTER_OTLP_ENDPOINT")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 15*time.Second, "how long in-flight calls and the event consumer may take to finish on shutdown")
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	require := func(value string, name string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+	oneOf := func(value string, name string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		errs = append(errs, fmt.Errorf("%s must be one of %s", name, strings.Join(allowed, ", ")))
+	}
+	positive := func(value int64, name string) {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", name))
+		}
+	}
+	notNegative := func(value int64, name string) {
+		if value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", name))
+		}
+	}
+
+	positive(int64(c.Port), "port")
+	positive(int64(c.HTTPPort), "http-port")
+	positive(int64(c.HealthCheckInterval), "health-check-interval")
+	require(c.DBHost, "db-host")
+	positive(int64(c.DBPort), "db-port")
+	require(c.DBName, "db-name")
+	require(c.DBUsername, "db-username")
+	require(c.DBPassword, "db-password")
+	notNegative(int64(c.DBMaxOpenConns), "db-max-open-conns")
+	notNegative(int64(c.DBMaxIdleConns), "db-max-idle-conns")
+	notNegative(int64(c.DBConnMaxLifetime), "db-conn-max-lifetime")
+	notNegative(int64(c.DBConnMaxIdleTime), "db-conn-max-idle-time")
+	positive(int64(c.DBConnectTimeout), "db-connect-timeout")
+	positive(int64(c.DBRetryAttempts), "db-retry-attempts")
+	require(c.KafkaURL, "kafka-url")
+	oneOf(c.DeletedAuthorPosts, "deleted-author-posts", "anonymise", "delete")
+	positive(int64(c.PostRetention), "post-retention")
+	positive(int64(c.PurgeInterval), "purge-interval")
+	if c.TLSCert != "" && c.TLSKey == "" {
+		errs = append(errs, errors.New("tls-key is required with tls-cert"))
+	}
+	if c.TLSCert == "" && c.TLSClientCA != "" {
+		errs = append(errs, errors.New("tls-client-ca requires tls-cert"))
+	}
+
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.LogLevel))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("log-level: %w", err))
+	}
+	oneOf(c.TracingExporter, "tracing-exporter", "none", "stdout", "otlp")
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"common/database"
+)
+
+// RunInTx runs fn in a gorm transaction, and again in a new one if it failed
+// transiently. Side effects of fn outside of tx must be safe to repeat. A
+// failed commit is returned as a *database.CommitError.
+func RunInTx(ctx context.Context, db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	return database.Retry(ctx, func() error {
+		tx := db.WithContext(ctx).Begin()
+		if tx.Error != nil {
+			return tx.Error
+		}
+		committed := false
+		defer func() {
+			if !committed {
+				tx.Rollback()
+			}
+		}()
+
+		err := fn(tx)
+		if err != nil {
+			return err
+		}
+		committed = true
+		err = tx.Commit().Error
+		if err != nil {
+			return &database.CommitError{Err: err}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/segmentio/kafka-go"
+	"gorm.io/gorm"
+
+	"common/logging"
+	"common/metrics"
+)
+
+const (
+	UserDeletedEvent = "user.deleted"
+
+	DeletedAuthor = "[deleted]"
+)
+
+type UserEvent struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+}
+
+type DeletionProgress struct {
+	Username string `json:"username"`
+	Service  string `json:"service"`
+}
+
+// RemoveAuthor anonymises or permanently deletes all posts of a deleted user,
+// including deleted ones, and their revisions with them. Running it again for the same user is a no-op.
+func RemoveAuthor(db *gorm.DB, username string, deletePosts bool) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if deletePosts {
+			err := tx.Where("post_id IN (?)", tx.Unscoped().Model(&Post{}).Select("id").Where("username = ?", username)).
+				Delete(&PostRevision{}).Error
+			if err != nil {
+				return err
+			}
+			return tx.Unscoped().Where("username = ?", username).Delete(&Post{}).Error
+		}
+
+		err := tx.Model(&PostRevision{}).Where("editor = ?", username).Update("editor", DeletedAuthor).Error
+		if err != nil {
+			return err
+		}
+		// Deleted posts are anonymised too, they are kept until purged.
+		return tx.Unscoped().Model(&Post{}).Where("username = ?", username).Update("username", DeletedAuthor).Error
+	})
+}
+
+// ConsumeUserEvents runs until ctx is cancelled. A message that is already
+// read is still processed and reported.
+func ConsumeUserEvents(ctx context.Context, db *gorm.DB, kafkaURL string, deletePosts bool) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: []string{kafkaURL},
+		Topic:   "users",
+		GroupID: "post_service",
+	})
+	defer reader.Close()
+
+	writer := &kafka.Writer{
+		Addr:  kafka.TCP(kafkaURL),
+		Topic: "user-deletion-progress",
+	}
+	defer writer.Close()
+
+	for {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			metrics.KafkaConsumeErrors.WithLabelValues(reader.Config().Topic, "read").Inc()
+			slog.ErrorContext(ctx, "Failed to read message from Kafka", "topic", reader.Config().Topic, "error", err)
+			continue
+		}
+		metrics.ObserveKafkaRead(reader)
+		msgCtx := logging.WithMessageRequestID(ctx, &msg)
+
+		var event UserEvent
+		err = json.Unmarshal(msg.Value, &event)
+		if err != nil {
+			metrics.KafkaConsumeErrors.WithLabelValues(reader.Config().Topic, "decode").Inc()
+			slog.ErrorContext(msgCtx, "Failed to deserialize message", "topic", msg.Topic, "error", err)
+			continue
+		}
+		if event.Type != UserDeletedEvent {
+			continue
+		}
+
+		err = RemoveAuthor(db, event.Username, deletePosts)
+		if err != nil {
+			metrics.KafkaConsumeErrors.WithLabelValues(reader.Config().Topic, "process").Inc()
+			slog.ErrorContext(msgCtx, "Failed to remove posts of deleted user", "user", event.Username, "error", err)
+			continue
+		}
+
+		progress, err := json.Marshal(DeletionProgress{
+			Username: event.Username,
+			Service:  "post_service",
+		})
+		if err != nil {
+			slog.ErrorContext(msgCtx, "Failed to serialize message", "error", err)
+			continue
+		}
+
+		err = metrics.WriteKafka(msgCtx, writer, kafka.Message{
+			Key:   []byte(event.Username),
+			Value: progress,
+		})
+		if err != nil {
+			slog.ErrorContext(msgCtx, "Failed to report deletion progress", "user", event.Username, "error", err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"gorm.io/gorm"
+
+	commonhealth "common/health"
+	pb "post_service/proto"
+)
+
+func PostgresCheck(db *gorm.DB) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return err
+		}
+		return sqlDB.PingContext(ctx)
+	}
+}
+
+// NewHealthHandler serves /healthz and /readyz for probes that speak HTTP
+// rather than gRPC, and /metrics.
+func NewHealthHandler(checks []commonhealth.Check) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", commonhealth.Healthz)
+	mux.Handle("GET /readyz", commonhealth.Readyz(checks))
+	return mux
+}
+
+// WatchHealth keeps the grpc.health.v1 status of the post service in line
+// with the readiness checks until ctx is cancelled.
+func WatchHealth(ctx context.Context, server *health.Server, checks []commonhealth.Check, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		status := healthpb.HealthCheckResponse_SERVING
+		report := commonhealth.Run(ctx, checks)
+		if report.Status != "ok" {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+			slog.Warn("Post service is not ready", "checks", report.Checks)
+		}
+		server.SetServingStatus("", status)
+		server.SetServingStatus(pb.PostService_ServiceDesc.ServiceName, status)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"common/logging"
+)
+
+// GRPCLogging continues the request ID sent by user_service and writes one
+// log line per call.
+func GRPCLogging(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	requestIds := md.Get(logging.RequestIDMetadata)
+	if len(requestIds) > 0 && logging.ValidRequestID(requestIds[0]) {
+		ctx = logging.WithRequestID(ctx, requestIds[0])
+	}
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	attrs := []any{
+		slog.String("method", info.FullMethod),
+		slog.String("code", status.Code(err).String()),
+		slog.Duration("latency", time.Since(start)),
+	}
+	if r, ok := req.(interface{ GetUsername() string }); ok && r.GetUsername() != "" {
+		attrs = append(attrs, slog.String("user", r.GetUsername()))
+	}
+	if r, ok := req.(interface{ GetId() uint64 }); ok && r.GetId() != 0 {
+		attrs = append(attrs, slog.Uint64("post_id", r.GetId()))
+	}
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	slog.Log(ctx, level, "Call served", attrs...)
+	return resp, err
+}
@@ -1,38 +1,48 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/XSAM/otelsql"
 	_ "github.com/lib/pq"
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 
+	"common/config"
+	"common/database"
+	commonhealth "common/health"
+	"common/logging"
+	"common/tracing"
 	pb "post_service/proto"
 )
 
-func CreateDatabase(dbInfo string, dbName string) error {
+func CreateDatabase(dbInfo string, dbName string, connectTimeout time.Duration) error {
 	db, err := sql.Open("postgres", dbInfo)
 	if err != nil {
 	 	return err
 	}
 	defer db.Close()
 
-	for i := 0; i < 5; i++ {
-		err = db.Ping()
-		if err == nil {
-			break
-		}
-		time.Sleep(time.Second)
-	}
-	err = db.Ping()
+	err = database.Wait(context.Background(), db, connectTimeout)
 	if err != nil {
-		panic(err)
+		return err
 	}
    
 	_, err = db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbName))
@@ -48,72 +58,193 @@ func CreateDatabase(dbInfo string, dbName string) error {
 }   
 
 func main() {
-	port := flag.Int("port", 8090, "http server port")
-	dbHost := flag.String("db-host", "", "hostname of the database")
-	dbPort := flag.Int("db-port", 5433, "port of the database")
-	dbName := flag.String("db-name", "", "database name")
-	dbUsername := flag.String("db-username", "", "database user")
-	dbPassword := flag.String("db-password", "", "database password")
-
-	flag.Parse()
-
-	if port == nil {
-		fmt.Fprintln(os.Stderr, "Port is required")
-		os.Exit(1)
-	}
-	if dbHost == nil || *dbHost == "" {
-		fmt.Fprintln(os.Stderr, "Please provide a hostname of the database")
-		os.Exit(1)
-	}
-	if dbPort == nil {
-		fmt.Fprintln(os.Stderr, "Please provide a port of the database")
-		os.Exit(1)
-	}
-	if dbName == nil || *dbName == ""  {
-		fmt.Fprintln(os.Stderr, "Please provide a database name")
-		os.Exit(1)
-	}
-	if dbUsername == nil || *dbUsername == ""  {
-		fmt.Fprintln(os.Stderr, "Please provide a database username")
+	var cfg Config
+	cfg.RegisterFlags(flag.CommandLine)
+	err := config.Load(flag.CommandLine, envPrefix, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
 		os.Exit(1)
 	}
-	if dbPassword == nil || *dbPassword == ""  {
-		fmt.Fprintln(os.Stderr, "Please provide a database password")
+	err = cfg.Validate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
 		os.Exit(1)
 	}
 
+	logging.Init("post_service", cfg.LogLevel)
+	config.Log(flag.CommandLine, secretSettings)
+
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s sslmode=disable",
-		*dbHost, *dbPort, *dbUsername, *dbPassword)
+		cfg.DBHost, cfg.DBPort, cfg.DBUsername, cfg.DBPassword)
+
+	shutdownTracing, err := tracing.Init(context.Background(), "post_service", cfg.TracingExporter, cfg.OTLPEndpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to set up tracing:", err)
+		os.Exit(1)
+	}
 
-	err := CreateDatabase(psqlInfo, *dbName)
+	err = CreateDatabase(psqlInfo, cfg.DBName, cfg.DBConnectTimeout)
 	if err != nil {
 		panic("Failed to create database: " + err.Error())
 	}
 
 	psqlInfo = fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		*dbHost, *dbPort, *dbUsername, *dbPassword, *dbName)
+		cfg.DBHost, cfg.DBPort, cfg.DBUsername, cfg.DBPassword, cfg.DBName)
+
+	// gorm runs on a traced connection pool, queries made with the context of
+	// a call show up as spans of that call.
+	sqlDB, err := otelsql.Open("pgx", psqlInfo,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{SpanFilter: tracing.TracedQueriesOnly}),
+	)
+	if err != nil {
+		panic("Failed to connect database: " + err.Error())
+	}
+	database.PoolConfig{
+		MaxOpenConns:    cfg.DBMaxOpenConns,
+		MaxIdleConns:    cfg.DBMaxIdleConns,
+		ConnMaxLifetime: cfg.DBConnMaxLifetime,
+		ConnMaxIdleTime: cfg.DBConnMaxIdleTime,
+	}.Apply(sqlDB)
+	database.Policy.MaxAttempts = cfg.DBRetryAttempts
 
-	db, err := gorm.Open(postgres.Open(psqlInfo), &gorm.Config{})
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{})
 	if err != nil {
 		panic("Failed to connect database: " + err.Error())
 	}
 
-	db.Migrator().DropTable(&Post{})
-	err = db.AutoMigrate(&Post{})
+	db.Migrator().DropTable(&PostRevision{}, &Post{})
+	err = db.AutoMigrate(&Post{}, &PostRevision{})
 	if err != nil {
 		panic("Failed to migrate database: " + err.Error())
 	}
 
-	grpc_server := grpc.NewServer()
-	pb.RegisterPostServiceServer(grpc_server, &Server{DB: db})
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = RegisterDBMetrics(db, "posts")
+	if err != nil {
+		panic("Failed to register database metrics: " + err.Error())
+	}
+
+	readinessChecks := []commonhealth.Check{
+		{Name: "postgres", Check: PostgresCheck(db)},
+		{Name: "kafka", Check: commonhealth.KafkaCheck(cfg.KafkaURL)},
+	}
+	healthServer := health.NewServer()
+
+	postEventWriter := &kafka.Writer{
+		Addr:     kafka.TCP(cfg.KafkaURL),
+		Topic:    "posts",
+		Balancer: &kafka.Hash{},
+	}
+
+	var workers sync.WaitGroup
+	workers.Add(3)
+	go func() {
+		defer workers.Done()
+		ConsumeUserEvents(ctx, db, cfg.KafkaURL, cfg.DeletedAuthorPosts == "delete")
+	}()
+	go func() {
+		defer workers.Done()
+		WatchHealth(ctx, healthServer, readinessChecks, cfg.HealthCheckInterval)
+	}()
+	go func() {
+		defer workers.Done()
+		PurgeDeletedPosts(ctx, db, postEventWriter, cfg.PostRetention, cfg.PurgeInterval)
+	}()
+
+	var serverOptions []grpc.ServerOption
+	if cfg.TLSCert != "" {
+		creds, err := NewServerCredentials(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA, ParseAllowedClients(cfg.TLSAllowedClients))
+		if err != nil {
+			panic("Failed to configure TLS: " + err.Error())
+		}
+		serverOptions = append(serverOptions, grpc.Creds(creds))
+	}
+
+	serverOptions = append(serverOptions,
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(GRPCLogging, GRPCServerMetrics),
+	)
+	grpc_server := grpc.NewServer(serverOptions...)
+	pb.RegisterPostServiceServer(grpc_server, &Server{DB: db, Retention: cfg.PostRetention, Events: postEventWriter})
+	healthpb.RegisterHealthServer(grpc_server, healthServer)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
+	if err != nil {
+		panic(fmt.Sprintf("Failed to listen on port %d: %s", cfg.Port, err.Error()))
+	}
+
+	go func() {
+		err := grpc_server.Serve(listener)
+		if err != nil {
+			panic("Failed to serve: " + err.Error())
+		}
+	}()
+
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.HTTPPort),
+		Handler: NewHealthHandler(readinessChecks),
+	}
+	go func() {
+		err := httpServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Clients watching the health status move away before calls are refused.
+	healthServer.Shutdown()
+	err = httpServer.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Error("Failed to drain HTTP server", "error", err)
+	}
+
+	// GracefulStop waits for running calls without a deadline, so it is cut
+	// short with Stop after the timeout.
+	stopped := make(chan struct{})
+	go func() {
+		grpc_server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		slog.Warn("Calls did not finish in time")
+		grpc_server.Stop()
+	}
+
+	consumed := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(consumed)
+	}()
+	select {
+	case <-consumed:
+	case <-shutdownCtx.Done():
+		slog.Warn("Background workers did not stop in time")
+	}
+
+	err = postEventWriter.Close()
+	if err != nil {
+		slog.Error("Failed to flush Kafka writer", "topic", postEventWriter.Topic, "error", err)
+	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+	err = sqlDB.Close()
 	if err != nil {
-		panic(fmt.Sprintf("Failed to listen on port %d: %s", *port, err.Error()))
+		slog.Error("Failed to close database", "error", err)
 	}
 
-	err = grpc_server.Serve(listener)
+	err = shutdownTracing(shutdownCtx)
 	if err != nil {
-		panic("Failed to serve: " + err.Error())
+		slog.Error("Failed to flush spans", "error", err)
 	}
 }
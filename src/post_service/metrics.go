@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+// Kafka metrics are shared by all services, see common/metrics.
+var (
+	grpcServerCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_server_handled_total",
+		Help: "gRPC calls served by method and status code.",
+	}, []string{"method", "code"})
+	grpcServerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_server_handling_seconds",
+		Help:    "Time to serve gRPC calls by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+)
+
+func RegisterDBMetrics(db *gorm.DB, name string) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return prometheus.Register(collectors.NewDBStatsCollector(sqlDB, name))
+}
+
+func GRPCServerMetrics(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	grpcServerDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	grpcServerCalls.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"common/metrics"
+)
+
+const PostPurgedEvent = "post.purged"
+
+// PostEvent is published to the posts topic, keyed by post id.
+type PostEvent struct {
+	Type     string `json:"type"`
+	PostId   uint64 `json:"postId"`
+	Username string `json:"username"`
+}
+
+const purgeBatchSize = 100
+
+// purgePost publishes post.purged and then removes the post and its
+// revisions for good. The event goes out before the post is gone, so it may
+// repeat but is never lost. tx must hold the row lock of the post.
+func purgePost(ctx context.Context, tx *gorm.DB, writer *kafka.Writer, post *Post) error {
+	err := publishPostPurged(ctx, writer, post)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Where("post_id = ?", post.Id).Delete(&PostRevision{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Unscoped().Delete(&Post{}, post.Id).Error
+}
+
+func publishPostPurged(ctx context.Context, writer *kafka.Writer, post *Post) error {
+	msg, err := json.Marshal(PostEvent{
+		Type:     PostPurgedEvent,
+		PostId:   post.Id,
+		Username: post.Username,
+	})
+	if err != nil {
+		return err
+	}
+
+	return metrics.WriteKafka(ctx, writer, kafka.Message{
+		Key:   []byte(strconv.FormatUint(post.Id, 10)),
+		Value: msg,
+	})
+}
+
+// PurgeDeletedPosts permanently deletes posts that were deleted longer than
+// retention ago, until ctx is cancelled.
+func PurgeDeletedPosts(ctx context.Context, db *gorm.DB, writer *kafka.Writer, retention time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cutoff := time.Now().Add(-retention)
+		var posts []*Post
+		err := db.WithContext(ctx).Unscoped().Where("deleted_at < ?", cutoff).
+			Order("deleted_at").Limit(purgeBatchSize).Find(&posts).Error
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to list posts to purge", "error", err)
+			continue
+		}
+
+		for _, post := range posts {
+			purged := false
+			err = RunInTx(ctx, db, func(tx *gorm.DB) error {
+				// The post may have been restored since it was listed.
+				locked := &Post{}
+				err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+					Where("deleted_at < ?", cutoff).First(&locked, post.Id).Error
+				if err == gorm.ErrRecordNotFound {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				purged = true
+				return purgePost(ctx, tx, writer, locked)
+			})
+			if err != nil {
+				// Kafka or the database is down, the rest waits for the next round.
+				slog.ErrorContext(ctx, "Failed to purge post", "post_id", post.Id, "error", err)
+				break
+			}
+			if purged {
+				slog.InfoContext(ctx, "Purged post", "post_id", post.Id)
+			}
+		}
+	}
+}
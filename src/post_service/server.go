@@ -3,30 +3,105 @@ package main
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/segmentio/kafka-go"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
+	"common/database"
 	pb "post_service/proto"
 )
 
 type Server struct {
 	DB *gorm.DB
+	// Deleted posts can be restored for Retention, then they are purged.
+	Retention time.Duration
+	// Events receives post.purged for posts deleted permanently at once.
+	Events *kafka.Writer
 	pb.UnimplementedPostServiceServer
 }
 
+const (
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+func CanModerate(role string) bool {
+	return role == RoleModerator || role == RoleAdmin
+}
+
 type Post struct {
-	Id       uint64 `gorm:"primarykey"`
-	Username string
-	Content  string
+	Id         uint64 `gorm:"primarykey"`
+	Username   string
+	Content    string
+	Edited     bool
+	Visibility string `gorm:"not null;default:public"`
+	// Posts are soft deleted, gorm leaves them out of queries unless
+	// Unscoped is used.
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	// DeletedBy is who soft deleted the post, the creator or a moderator.
+	DeletedBy string
+}
+
+// PostRevision is the content a post had before an edit. Rows are only ever
+// added, and removed together with their post.
+type PostRevision struct {
+	Id        uint64 `gorm:"primarykey"`
+	PostId    uint64 `gorm:"uniqueIndex:idx_post_revision"`
+	Revision  uint64 `gorm:"uniqueIndex:idx_post_revision"`
+	Editor    string
+	Content   string
+	CreatedAt time.Time
+}
+
+func postToPb(post *Post) *pb.Post {
+	postPb := &pb.Post{
+		Id:         post.Id,
+		Username:   post.Username,
+		Content:    post.Content,
+		Edited:     post.Edited,
+		Visibility: post.Visibility,
+	}
+	if post.DeletedAt.Valid {
+		postPb.DeletedAt = post.DeletedAt.Time.Unix()
+	}
+	return postPb
+}
+
+func revisionToPb(revision *PostRevision) *pb.PostRevision {
+	return &pb.PostRevision{
+		PostId:    revision.PostId,
+		Revision:  revision.Revision,
+		Editor:    revision.Editor,
+		Content:   revision.Content,
+		CreatedAt: revision.CreatedAt.Unix(),
+	}
 }
 
 func (s *Server) CreatePost(ctx context.Context, req *pb.CreatePostRequest) (*pb.CreatePostResponse, error) {
-	post := &Post{
-		Username:  req.Username,
-		Content: req.Content,
+	visibility := req.Visibility
+	if visibility == "" {
+		visibility = VisibilityPublic
+	}
+	if !ValidVisibility(visibility) {
+		return nil, errors.New("Invalid visibility")
+	}
+
+	var post *Post
+	err := RunInTx(ctx, s.DB, func(tx *gorm.DB) error {
+		// A fresh post per attempt, the last one may have been given an id.
+		post = &Post{
+			Username:   req.Username,
+			Content:    req.Content,
+			Visibility: visibility,
+		}
+		return tx.Create(post).Error
+	})
+	if err != nil {
+		return nil, err
 	}
-	s.DB.Create(post)
 
 	return &pb.CreatePostResponse{
 		PostId: post.Id,
@@ -34,48 +109,149 @@ func (s *Server) CreatePost(ctx context.Context, req *pb.CreatePostRequest) (*pb
 }
 
 func (s *Server) UpdatePost(ctx context.Context, req *pb.UpdatePostRequest) (*empty.Empty, error) {
-	post := &Post{}
-	err := s.DB.First(&post, req.Id).Error
-	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return nil, errors.New("Post not found")
-		} else {
-			return nil, err
-		}
+	if req.Visibility != "" && !ValidVisibility(req.Visibility) {
+		return nil, errors.New("Invalid visibility")
 	}
 
-	if post.Username != req.Username {
-		return nil, errors.New("Only the creator can update the post")
-	}
+	err := RunInTx(ctx, s.DB, func(tx *gorm.DB) error {
+		// The row lock makes concurrent edits of a post take turns, so
+		// revision numbers are not handed out twice.
+		post := &Post{}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&post, req.Id).Error
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return errors.New("Post not found")
+			} else {
+				return err
+			}
+		}
 
-	post.Content = req.Content
-	s.DB.Save(&post)
+		if post.Username != req.Username {
+			return errors.New("Only the creator can update the post")
+		}
+		if req.Visibility != "" {
+			post.Visibility = req.Visibility
+		}
+		if post.Content == req.Content {
+			return tx.Save(&post).Error
+		}
+
+		var revisions int64
+		err = tx.Model(&PostRevision{}).Where("post_id = ?", post.Id).Count(&revisions).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Create(&PostRevision{
+			PostId:   post.Id,
+			Revision: uint64(revisions) + 1,
+			Editor:   req.Username,
+			Content:  post.Content,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		post.Content = req.Content
+		post.Edited = true
+		return tx.Save(&post).Error
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	return &empty.Empty{}, nil
 }
 
 func (s *Server) DeletePost(ctx context.Context, req *pb.DeletePostRequest) (*empty.Empty, error) {
+	if req.Permanent && !CanModerate(req.Role) {
+		return nil, errors.New("Only a moderator can delete a post permanently")
+	}
+
 	post := &Post{}
-	err := s.DB.First(&post, req.Id).Error
-	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return nil, errors.New("Post not found")
-		} else {
-			return nil, err
+	err := RunInTx(ctx, s.DB, func(tx *gorm.DB) error {
+		// Posts that are already deleted can still be deleted permanently.
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE"})
+		if req.Permanent {
+			query = query.Unscoped()
+		}
+		err := query.First(&post, req.Id).Error
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return errors.New("Post not found")
+			} else {
+				return err
+			}
 		}
+
+		if post.Username != req.Username && !CanModerate(req.Role) {
+			return errors.New("Only the creator or a moderator can delete the post")
+		}
+
+		if req.Permanent {
+			// Fails the deletion if post.purged cannot be published.
+			return purgePost(ctx, tx, s.Events, post)
+		}
+		err = tx.Model(&post).Update("deleted_by", req.Username).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&Post{}, req.Id).Error
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if post.Username != req.Username {
-		return nil, errors.New("Only the creator can delete the post")
+	return &empty.Empty{}, nil
+}
+
+func (s *Server) RestorePost(ctx context.Context, req *pb.RestorePostRequest) (*empty.Empty, error) {
+	err := RunInTx(ctx, s.DB, func(tx *gorm.DB) error {
+		post := &Post{}
+		// The row lock keeps the purger from removing the post meanwhile.
+		err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).Where("deleted_at IS NOT NULL").First(&post, req.Id).Error
+		if err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return errors.New("Deleted post not found")
+			} else {
+				return err
+			}
+		}
+
+		if post.Username != req.Username {
+			return errors.New("Only the creator can restore the post")
+		}
+		if post.DeletedBy != post.Username {
+			return errors.New("Posts removed by a moderator cannot be restored")
+		}
+		// The purger may not have run yet, but the post is already gone.
+		if time.Since(post.DeletedAt.Time) > s.Retention {
+			return errors.New("Post can no longer be restored")
+		}
+
+		return tx.Unscoped().Model(&post).Updates(map[string]interface{}{"deleted_at": nil, "deleted_by": ""}).Error
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	s.DB.Delete(&Post{}, req.Id)
 	return &empty.Empty{}, nil
 }
 
-func (s *Server) GetPost(ctx context.Context, req *pb.GetPostRequest) (*pb.GetPostResponse, error) {
+// maxPageSize bounds the posts or revisions of one list call. Larger limits
+// could also overflow int, and gorm reads a negative limit as none at all.
+const maxPageSize = 100
+
+func pageLimit(limit uint64) int {
+	return int(min(limit, maxPageSize))
+}
+
+// findVisiblePost loads a post viewer may see. Posts hidden from viewer are
+// reported as not found, so their existence does not leak.
+func (s *Server) findVisiblePost(ctx context.Context, id uint64, viewer *pb.Viewer) (*Post, error) {
 	post := &Post{}
-	err := s.DB.First(&post, req.Id).Error
+	err := database.Retry(ctx, func() error {
+		return s.DB.WithContext(ctx).First(&post, id).Error
+	})
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, errors.New("Post not found")
@@ -83,30 +259,101 @@ func (s *Server) GetPost(ctx context.Context, req *pb.GetPostRequest) (*pb.GetPo
 			return nil, err
 		}
 	}
+	if !CanView(post, viewer) {
+		return nil, errors.New("Post not found")
+	}
+	return post, nil
+}
+
+func (s *Server) GetPost(ctx context.Context, req *pb.GetPostRequest) (*pb.GetPostResponse, error) {
+	post, err := s.findVisiblePost(ctx, req.Id, req.Viewer)
+	if err != nil {
+		return nil, err
+	}
 
 	return &pb.GetPostResponse{
-		Post: &pb.Post{
-			Id:      post.Id,
-			Username:  post.Username,
-			Content: post.Content,
-		},
+		Post: postToPb(post),
 	}, nil
 }
 
 func (s *Server) ListPosts(ctx context.Context, req *pb.ListPostsRequest) (*pb.ListPostsResponse, error) {
+	query := s.DB.WithContext(ctx).Limit(pageLimit(req.Limit)).Offset(int(req.Offset)).Order("id")
+	if req.Deleted {
+		if req.Username == "" {
+			return nil, errors.New("Deleted posts are only listed for a user")
+		}
+		query = query.Unscoped().Where("deleted_at > ?", time.Now().Add(-s.Retention))
+	}
+	if req.Username != "" {
+		query = query.Where("username = ?", req.Username)
+	}
+	query = listedFor(query, req.Viewer)
+
 	var posts []*Post
-	s.DB.Limit(int(req.Limit)).Offset(int(req.Offset)).Find(&posts)
+	err := database.Retry(ctx, func() error {
+		posts = nil
+		return query.Find(&posts).Error
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	var postsPb []*pb.Post
 	for _, post := range posts {
-		postsPb = append(postsPb, &pb.Post{
-			Id:      post.Id,
-			Username:  post.Username,
-			Content: post.Content,
-		})
+		postsPb = append(postsPb, postToPb(post))
 	}
 
 	return &pb.ListPostsResponse{
 		Posts: postsPb,
 	}, nil
 }
+
+func (s *Server) ListPostRevisions(ctx context.Context, req *pb.ListPostRevisionsRequest) (*pb.ListPostRevisionsResponse, error) {
+	_, err := s.findVisiblePost(ctx, req.PostId, req.Viewer)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []*PostRevision
+	err = database.Retry(ctx, func() error {
+		revisions = nil
+		return s.DB.WithContext(ctx).Where("post_id = ?", req.PostId).
+			Limit(pageLimit(req.Limit)).Offset(int(req.Offset)).Order("revision").Find(&revisions).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var revisionsPb []*pb.PostRevision
+	for _, revision := range revisions {
+		revisionsPb = append(revisionsPb, revisionToPb(revision))
+	}
+
+	return &pb.ListPostRevisionsResponse{
+		Revisions: revisionsPb,
+	}, nil
+}
+
+func (s *Server) GetPostRevision(ctx context.Context, req *pb.GetPostRevisionRequest) (*pb.GetPostRevisionResponse, error) {
+	// Revisions are hidden together with their post.
+	_, err := s.findVisiblePost(ctx, req.PostId, req.Viewer)
+	if err != nil {
+		return nil, err
+	}
+
+	revision := &PostRevision{}
+	err = database.Retry(ctx, func() error {
+		return s.DB.WithContext(ctx).Where("post_id = ? AND revision = ?", req.PostId, req.Revision).First(&revision).Error
+	})
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.New("Revision not found")
+		} else {
+			return nil, err
+		}
+	}
+
+	return &pb.GetPostRevisionResponse{
+		Revision: revisionToPb(revision),
+	}, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+
+	"common/certs"
+)
+
+// AllowedClients checks the identity of a verified client certificate.
+// Entries are matched against the DNS, URI and e-mail SANs of the leaf.
+type AllowedClients map[string]bool
+
+func ParseAllowedClients(list string) AllowedClients {
+	allowed := AllowedClients{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			allowed[name] = true
+		}
+	}
+	return allowed
+}
+
+func (a AllowedClients) Check(cert *x509.Certificate) error {
+	if len(a) == 0 {
+		return nil
+	}
+	var names []string
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, name := range names {
+		if a[name] {
+			return nil
+		}
+	}
+	return fmt.Errorf("Client identity %v is not allowed", names)
+}
+
+func NewServerCredentials(certFile string, keyFile string, clientCAFile string, allowed AllowedClients) (credentials.TransportCredentials, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("Both TLS certificate and key are required")
+	}
+	if len(allowed) > 0 && clientCAFile == "" {
+		return nil, errors.New("Allowed clients require a client CA")
+	}
+
+	reloader, err := certs.NewReloader(certFile, keyFile, clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   []string{"h2"},
+				Certificates: []tls.Certificate{*reloader.Certificate()},
+			}
+			if clientCAFile != "" {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = reloader.CAPool()
+				config.VerifyConnection = func(state tls.ConnectionState) error {
+					if len(state.PeerCertificates) == 0 {
+						return errors.New("No client certificate")
+					}
+					return allowed.Check(state.PeerCertificates[0])
+				}
+			}
+			return config, nil
+		},
+	}
+	return credentials.NewTLS(config), nil
+}
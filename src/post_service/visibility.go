@@ -0,0 +1,56 @@
+package main
+
+import (
+	"slices"
+
+	"gorm.io/gorm"
+
+	pb "post_service/proto"
+)
+
+const (
+	VisibilityPublic    = "public"
+	VisibilityFollowers = "followers"
+	VisibilityPrivate   = "private"
+	VisibilityUnlisted  = "unlisted"
+)
+
+func ValidVisibility(visibility string) bool {
+	switch visibility {
+	case VisibilityPublic, VisibilityFollowers, VisibilityPrivate, VisibilityUnlisted:
+		return true
+	}
+	return false
+}
+
+// CanView reports whether viewer may see post when asking for it by id.
+// viewer is nil for anonymous requests.
+func CanView(post *Post, viewer *pb.Viewer) bool {
+	if post.Visibility == VisibilityPublic || post.Visibility == VisibilityUnlisted {
+		return true
+	}
+	if viewer == nil {
+		return false
+	}
+	if viewer.Username == post.Username || CanModerate(viewer.Role) {
+		return true
+	}
+	return post.Visibility == VisibilityFollowers && slices.Contains(viewer.Following, post.Username)
+}
+
+// listedFor restricts query to the posts viewer may see in lists, which
+// leaves out unlisted posts of other users. user_service caps
+// viewer.Following well below the bind parameter limit of PostgreSQL.
+func listedFor(query *gorm.DB, viewer *pb.Viewer) *gorm.DB {
+	if viewer == nil {
+		return query.Where("visibility = ?", VisibilityPublic)
+	}
+	if CanModerate(viewer.Role) {
+		return query
+	}
+	if len(viewer.Following) == 0 {
+		return query.Where("(visibility = ? OR username = ?)", VisibilityPublic, viewer.Username)
+	}
+	return query.Where("(visibility = ? OR username = ? OR (visibility = ? AND username IN ?))",
+		VisibilityPublic, viewer.Username, VisibilityFollowers, viewer.Following)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	ConfigFile string
+
+	Port         int
+	InternalPort int
+	DBAddress    string
+	DBName       string
+	KafkaURL     string
+
+	LogLevel        string
+	TracingExporter string
+	OTLPEndpoint    string
+	ShutdownTimeout time.Duration
+}
+
+// envPrefix starts the environment variables of the settings, e.g.
+// STATISTICS_SERVICE_KAFKA_URL.
+const envPrefix = "STATISTICS_SERVICE_"
+
+// secretSettings are never printed. Like every setting they can be read from
+// a file named by the STATISTICS_SERVICE_<NAME>_FILE environment variable.
+// Passwords inside db-address are redacted anyway.
+var secretSettings = map[string]bool{}
+
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "config", "", "YAML `file` with settings named like the flags, STATISTICS_SERVICE_CONFIG_FILE is used if empty")
+
+	fs.IntVar(&c.Port, "port", 8090, "http server port")
+	fs.IntVar(&c.InternalPort, "internal-port", 8101, "port of the HTTP server with /metrics and, for other services, /users/{username}/activity, never publish it")
+	fs.StringVar(&c.DBAddress, "db-address", "", "address of the database")
+	fs.StringVar(&c.DBName, "db-name", "", "database name")
+	fs.StringVar(&c.KafkaURL, "kafka-url", "", "address of the Kafka")
+
+	fs.StringVar(&c.LogLevel, "log-level", "info", "lowest level that is logged: debug, info, warn or error")
+	fs.StringVar(&c.TracingExporter, "tracing-exporter", "none", "where spans are sent: none, stdout or otlp")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", "", "URL of the OTLP gRPC collector, e.g. http://jaeger:4317, defaults to OTEL_EXPORTER_OTLP_ENDPOINT")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 15*time.Second, "how long in-flight requests and consumers may take to finish on shutdown")
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	require := func(value string, name string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+	oneOf := func(value string, name string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		errs = append(errs, fmt.Errorf("%s must be one of %s", name, strings.Join(allowed, ", ")))
+	}
+	positive := func(value int64, name string) {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", name))
+		}
+	}
+
+	positive(int64(c.Port), "port")
+	positive(int64(c.InternalPort), "internal-port")
+	if c.InternalPort == c.Port {
+		errs = append(errs, errors.New("internal-port must differ from port"))
+	}
+	require(c.DBAddress, "db-address")
+	require(c.DBName, "db-name")
+	require(c.KafkaURL, "kafka-url")
+
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.LogLevel))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("log-level: %w", err))
+	}
+	oneOf(c.TracingExporter, "tracing-exporter", "none", "stdout", "otlp")
+
+	return errors.Join(errs...)
+}
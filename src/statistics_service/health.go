@@ -0,0 +1,9 @@
+package main
+
+import (
+	"context"
+)
+
+func CheckClickHouse(ctx context.Context) error {
+	return db.PingContext(ctx)
+}
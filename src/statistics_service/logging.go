@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"common/logging"
+	"common/metrics"
+)
+
+// RequestLogging assigns every request an ID, returns it in X-Request-ID and
+// writes one access log line once the request is served.
+func RequestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestId := req.Header.Get(logging.RequestIDHeader)
+		if !logging.ValidRequestID(requestId) {
+			requestId = logging.NewRequestID()
+		}
+		w.Header().Set(logging.RequestIDHeader, requestId)
+
+		ctx := logging.WithRequestID(req.Context(), requestId)
+		req = req.WithContext(ctx)
+
+		recorder := metrics.NewStatusRecorder(w)
+		start := time.Now()
+		next.ServeHTTP(recorder, req)
+
+		attrs := []any{
+			slog.String("method", req.Method),
+			slog.String("route", metrics.RouteTemplate(req)),
+			slog.String("path", req.URL.Path),
+			slog.Int("status", recorder.Status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client", req.RemoteAddr),
+		}
+		user := mux.Vars(req)["username"]
+		if user != "" {
+			attrs = append(attrs, slog.String("user", user))
+		}
+
+		level := slog.LevelInfo
+		if recorder.Status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.Log(ctx, level, "Request served", attrs...)
+	})
+}
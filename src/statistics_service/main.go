@@ -1,16 +1,31 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/XSAM/otelsql"
 	_ "github.com/lib/pq"
 	_ "github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+
+	"common/config"
+	"common/health"
+	"common/logging"
+	"common/metrics"
+	"common/tracing"
 )
 
 var db *sql.DB
@@ -21,7 +36,10 @@ func Ping(w http.ResponseWriter, _ *http.Request) {
 
 func CreateDatabase(dbAddress string, dbName string) error {
 	var err error
-	db, err = sql.Open("clickhouse", dbAddress)
+	db, err = otelsql.Open("clickhouse", dbAddress,
+		otelsql.WithAttributes(semconv.DBSystemClickhouse),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{SpanFilter: tracing.TracedQueriesOnly}),
+	)
     if err != nil {
         return err
     }
@@ -78,44 +96,124 @@ func CreateDatabase(dbAddress string, dbName string) error {
 }
 
 func main() {
-	port := flag.Int("port", 8090, "http server port")
-	dbAddress := flag.String("db-address", "", "address of the database")
-	dbName := flag.String("db-name", "", "database name")
-	kafkaURL := flag.String("kafka-url", "", "address of the Kafka")
-
-	flag.Parse()
-
-	if port == nil {
-		fmt.Fprintln(os.Stderr, "Port is required")
-		os.Exit(1)
-	}
-	if dbAddress == nil || *dbAddress == "" {
-		fmt.Fprintln(os.Stderr, "Please provide address of the database")
+	var cfg Config
+	cfg.RegisterFlags(flag.CommandLine)
+	err := config.Load(flag.CommandLine, envPrefix, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
 		os.Exit(1)
 	}
-	if dbName == nil || *dbName == ""  {
-		fmt.Fprintln(os.Stderr, "Please provide a database name")
+	err = cfg.Validate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
 		os.Exit(1)
 	}
-	if kafkaURL == nil || *kafkaURL == ""  {
-		fmt.Fprintln(os.Stderr, "Please provide Kafka address")
+
+	logging.Init("statistics_service", cfg.LogLevel)
+	config.Log(flag.CommandLine, secretSettings)
+
+	shutdownTracing, err := tracing.Init(context.Background(), "statistics_service", cfg.TracingExporter, cfg.OTLPEndpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to set up tracing:", err)
 		os.Exit(1)
 	}
 
-	err := CreateDatabase(*dbAddress, *dbName)
+	err = CreateDatabase(cfg.DBAddress, cfg.DBName)
 	if err != nil {
 		panic("Failed to create database: " + err.Error())
 	}
-	defer db.Close()
 
-	go ConsumeEvents("likes", *kafkaURL)
- 	go ConsumeEvents("views", *kafkaURL)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var consumers sync.WaitGroup
+	startConsumer := func(consume func(ctx context.Context)) {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			consume(ctx)
+		}()
+	}
+	startConsumer(func(ctx context.Context) {
+		ConsumeEvents(ctx, "likes", cfg.KafkaURL)
+	})
+	startConsumer(func(ctx context.Context) {
+		ConsumeEvents(ctx, "views", cfg.KafkaURL)
+	})
+	startConsumer(func(ctx context.Context) {
+		ConsumeUserEvents(ctx, cfg.KafkaURL)
+	})
+
+	readinessChecks := []health.Check{
+		{Name: "clickhouse", Check: CheckClickHouse},
+		{Name: "kafka", Check: health.KafkaCheck(cfg.KafkaURL)},
+	}
+
+	RegisterDBMetrics("statistics")
 
 	r := mux.NewRouter()
+	r.Use(otelmux.Middleware("statistics_service"), RequestLogging, metrics.HTTP)
 	r.HandleFunc("/ping", Ping).Methods("GET")
+	r.HandleFunc("/healthz", health.Healthz).Methods("GET")
+	r.Handle("/readyz", health.Readyz(readinessChecks)).Methods("GET")
+
+	// The activity of a user is only for user_service, which serves it to the
+	// user in the authenticated export. Metrics and activity are served on a
+	// port that is never published.
+	internal := mux.NewRouter()
+	internal.Use(otelmux.Middleware("statistics_service"), RequestLogging, metrics.HTTP)
+	internal.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	internal.HandleFunc("/users/{username}/activity", GetUserActivity).Methods("GET")
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Port),
+		Handler: r,
+	}
+	internalServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.InternalPort),
+		Handler: internal,
+	}
+	for _, srv := range []*http.Server{server, internalServer} {
+		go func() {
+			err := srv.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				panic(err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	for _, srv := range []*http.Server{server, internalServer} {
+		err = srv.Shutdown(shutdownCtx)
+		if err != nil {
+			slog.Error("Failed to drain HTTP server", "addr", srv.Addr, "error", err)
+		}
+	}
+
+	consumed := make(chan struct{})
+	go func() {
+		consumers.Wait()
+		close(consumed)
+	}()
+	select {
+	case <-consumed:
+	case <-shutdownCtx.Done():
+		slog.Warn("Consumers did not stop in time")
+	}
+
+	err = db.Close()
+	if err != nil {
+		slog.Error("Failed to close database", "error", err)
+	}
 
-	err = http.ListenAndServe(fmt.Sprintf(":%d", *port), r)
+	err = shutdownTracing(shutdownCtx)
 	if err != nil {
-		panic(err)
+		slog.Error("Failed to flush spans", "error", err)
 	}
 }
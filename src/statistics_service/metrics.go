@@ -0,0 +1,12 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// HTTP and Kafka metrics are shared by all services, see common/metrics.
+
+func RegisterDBMetrics(name string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
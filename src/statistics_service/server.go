@@ -4,10 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 
 	_ "github.com/lib/pq"
+	"github.com/gorilla/mux"
 	"github.com/segmentio/kafka-go"
+
+	"common/logging"
+	"common/metrics"
+	"common/tracing"
 )
 
 type Event struct {
@@ -15,7 +21,7 @@ type Event struct {
 	Username string `json:"username"`
 }
 
-func ConsumeEvents(topic string, kafkaURL string) {
+func ConsumeEvents(ctx context.Context, topic string, kafkaURL string) {
 	reader := kafka.NewReader(kafka.ReaderConfig{
 		Brokers:  []string{kafkaURL},
 		Topic:    topic,
@@ -23,23 +29,177 @@ func ConsumeEvents(topic string, kafkaURL string) {
 	defer reader.Close()
    
 	for {
-		msg, err := reader.ReadMessage(context.Background())
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			metrics.KafkaConsumeErrors.WithLabelValues(topic, "read").Inc()
+			slog.ErrorContext(ctx, "Failed to read message from Kafka", "topic", topic, "error", err)
+			continue
+		}
+		metrics.ObserveKafkaRead(reader)
+		msgCtx := logging.WithMessageRequestID(ctx, &msg)
+
+		err = recordEvent(msgCtx, topic, &msg)
+		if err != nil {
+			slog.ErrorContext(msgCtx, "Failed to record event", "topic", topic, "error", err)
+		}
+	}
+}
+
+// recordEvent stores a like or view in the trace started by the request
+// that produced it.
+func recordEvent(ctx context.Context, topic string, msg *kafka.Message) error {
+	ctx, span := tracing.StartKafkaProcess(ctx, msg)
+
+	var event Event
+	err := json.Unmarshal(msg.Value, &event)
+	if err != nil {
+		metrics.KafkaConsumeErrors.WithLabelValues(topic, "decode").Inc()
+		tracing.EndSpan(span, err)
+		return fmt.Errorf("invalid event: %w", err)
+	}
+	slog.DebugContext(ctx, "Recording event", "topic", topic, "post_id", event.PostId, "user", event.Username)
+
+	_, err = db.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (postId, username) VALUES (%s, '%s')", topic, event.PostId, event.Username))
+	if err != nil {
+		metrics.KafkaConsumeErrors.WithLabelValues(topic, "process").Inc()
+	}
+	tracing.EndSpan(span, err)
+	return err
+}
+
+const UserDeletedEvent = "user.deleted"
+
+type UserEvent struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+}
+
+type DeletionProgress struct {
+	Username string `json:"username"`
+	Service  string `json:"service"`
+}
+
+// PurgeUser removes likes and views of a deleted user. Mutations are applied
+// synchronously, so the progress is only reported once the data is gone.
+func PurgeUser(username string) error {
+	for _, table := range []string{"likes", "views"} {
+		_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s DELETE WHERE username = ? SETTINGS mutations_sync = 1", table), username)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ConsumeUserEvents(ctx context.Context, kafkaURL string) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: []string{kafkaURL},
+		Topic:   "users",
+		GroupID: "statistics_service",
+	})
+	defer reader.Close()
+
+	writer := &kafka.Writer{
+		Addr:  kafka.TCP(kafkaURL),
+		Topic: "user-deletion-progress",
+	}
+	defer writer.Close()
+
+	for {
+		msg, err := reader.ReadMessage(ctx)
 		if err != nil {
-			log.Printf("Failed to read message from Kafka %s: %s", topic, err)
+			if ctx.Err() != nil {
+				return
+			}
+			metrics.KafkaConsumeErrors.WithLabelValues(reader.Config().Topic, "read").Inc()
+			slog.ErrorContext(ctx, "Failed to read message from Kafka", "topic", reader.Config().Topic, "error", err)
 			continue
 		}
-	
-		var event Event
+		metrics.ObserveKafkaRead(reader)
+		msgCtx := logging.WithMessageRequestID(ctx, &msg)
+
+		var event UserEvent
 		err = json.Unmarshal(msg.Value, &event)
 		if err != nil {
-			log.Printf("Failed to deserialize message: %s", err)
+			metrics.KafkaConsumeErrors.WithLabelValues(reader.Config().Topic, "decode").Inc()
+			slog.ErrorContext(msgCtx, "Failed to deserialize message", "topic", msg.Topic, "error", err)
+			continue
+		}
+		if event.Type != UserDeletedEvent {
+			continue
+		}
+
+		err = PurgeUser(event.Username)
+		if err != nil {
+			metrics.KafkaConsumeErrors.WithLabelValues(reader.Config().Topic, "process").Inc()
+			slog.ErrorContext(msgCtx, "Failed to purge statistics of deleted user", "user", event.Username, "error", err)
 			continue
 		}
 
-		_, err = db.Exec(fmt.Sprintf("INSERT INTO %s (postId, username) VALUES (%s, '%s')", topic, event.PostId, event.Username))
+		progress, err := json.Marshal(DeletionProgress{
+			Username: event.Username,
+			Service:  "statistics_service",
+		})
 		if err != nil {
-			log.Printf("Failed to write %s: %s", topic, err)
+			slog.ErrorContext(msgCtx, "Failed to serialize message", "error", err)
 			continue
 		}
+
+		err = metrics.WriteKafka(msgCtx, writer, kafka.Message{
+			Key:   []byte(event.Username),
+			Value: progress,
+		})
+		if err != nil {
+			slog.ErrorContext(msgCtx, "Failed to report deletion progress", "user", event.Username, "error", err)
+		}
 	}
 }
+
+type UserActivity struct {
+	Likes []uint64 `json:"likes"`
+	Views []uint64 `json:"views"`
+}
+
+func listPostIds(ctx context.Context, table string, username string) ([]uint64, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT postId FROM %s FINAL WHERE username = ? ORDER BY postId", table), username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	postIds := []uint64{}
+	for rows.Next() {
+		var postId uint64
+		err = rows.Scan(&postId)
+		if err != nil {
+			return nil, err
+		}
+		postIds = append(postIds, postId)
+	}
+	return postIds, rows.Err()
+}
+
+func GetUserActivity(w http.ResponseWriter, req *http.Request) {
+	username := mux.Vars(req)["username"]
+
+	likes, err := listPostIds(req.Context(), "likes", username)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list likes: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	views, err := listPostIds(req.Context(), "views", username)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list views: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UserActivity{
+		Likes: likes,
+		Views: views,
+	})
+}
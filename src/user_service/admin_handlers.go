@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/gorilla/mux"
+)
+
+type UserSummary struct {
+	Id        uint64    `json:"id"`
+	Username  string    `json:"username"`
+	Role      Role      `json:"role"`
+	Banned    bool      `json:"banned"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type RoleUpdate struct {
+	Role string `json:"role"`
+}
+
+// PromoteAdmins gives the admin role to the existing accounts named in
+// usernames and returns how many it changed. Registration never grants a
+// role, whoever registered a configured name first would be admin otherwise.
+func PromoteAdmins(ctx context.Context, usernames []string) (int64, error) {
+	lower := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		lower = append(lower, strings.ToLower(username))
+	}
+
+	result, err := db.ExecContext(ctx, "UPDATE users SET role=$1 WHERE lower(username) = ANY($2) AND deletedAt IS NULL AND role <> $1",
+		RoleAdmin, pq.Array(lower))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func ListUsers(w http.ResponseWriter, req *http.Request) {
+	limit, offset, ok := ParsePage(w, req)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query("SELECT id, username, role, banned, createdAt FROM users ORDER BY createdAt DESC, id DESC LIMIT $1 OFFSET $2",
+		limit, offset)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list users: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []UserSummary{}
+	for rows.Next() {
+		var user UserSummary
+		err = rows.Scan(&user.Id, &user.Username, &user.Role, &user.Banned, &user.CreatedAt)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list users: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		users = append(users, user)
+	}
+	if rows.Err() != nil {
+		http.Error(w, fmt.Sprintf("Failed to list users: %s", rows.Err().Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+func setUserBanned(w http.ResponseWriter, req *http.Request, banned bool) {
+	username := mux.Vars(req)["username"]
+	if banned && strings.EqualFold(username, CurrentPrincipal(req).Username) {
+		http.Error(w, "Cannot ban yourself", http.StatusBadRequest)
+		return
+	}
+
+	var userId uint64
+	err := db.QueryRowContext(req.Context(), `
+		UPDATE users SET banned=$1 WHERE lower(username)=lower($2) AND deletedAt IS NULL
+		RETURNING id, username
+	`, banned, username).Scan(&userId, &username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update user: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	userCache.Invalidate(username)
+	if banned {
+		// Signed in devices must not outlive the ban.
+		err = RevokeSessions(userId, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func BanUser(w http.ResponseWriter, req *http.Request) {
+	setUserBanned(w, req, true)
+}
+
+func UnbanUser(w http.ResponseWriter, req *http.Request) {
+	setUserBanned(w, req, false)
+}
+
+func SetUserRole(w http.ResponseWriter, req *http.Request) {
+	update := RoleUpdate{}
+	if !DecodeJSON(w, req, &update) {
+		return
+	}
+
+	role, err := ParseRole(update.Role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	username := mux.Vars(req)["username"]
+	err = db.QueryRowContext(req.Context(), `
+		UPDATE users SET role=$1 WHERE lower(username)=lower($2) AND deletedAt IS NULL
+		RETURNING username
+	`, role, username).Scan(&username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update user: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	userCache.Invalidate(username)
+	w.WriteHeader(http.StatusOK)
+}
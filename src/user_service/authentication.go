@@ -9,14 +9,28 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func Authenticate(req *http.Request) (string, error) {
-	authHeader := req.Header.Get("Authorization")
-	if authHeader == "" {
-        return "", errors.New("No authentication token in header")
-    }
-	jwtToken := strings.TrimPrefix(authHeader, "Bearer ")
+type AccessToken struct {
+	Username  string
+	SessionId string
+}
+
+// Tokens other than access tokens carry a purpose claim, so that e.g. a
+// download link cannot be used to authenticate API requests.
+const (
+	PurposeAccess = ""
+	PurposeExport = "export"
+)
+
+func SignToken(purpose string, claims jwt.MapClaims) (string, error) {
+	if purpose != PurposeAccess {
+		claims["purpose"] = purpose
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	return token.SignedString(privateKey)
+}
 
-    token, err := jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
+func ParseToken(tokenString string, purpose string) (jwt.MapClaims, error) {
+    token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		_, ok := token.Method.(*jwt.SigningMethodRSA)
         if !ok {
             return "", fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
@@ -24,17 +38,47 @@ func Authenticate(req *http.Request) (string, error) {
         return publicKey, nil
     })
 	if err != nil {
-        return "", err
+        return nil, err
     }
 	if !token.Valid {
-		return "", errors.New("Invalid authentication token")
+		return nil, errors.New("Invalid authentication token")
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
     if !ok {
-		return "", errors.New("Invalid authentication token")
+		return nil, errors.New("Invalid authentication token")
+    }
+
+	tokenPurpose, _ := claims["purpose"].(string)
+	if tokenPurpose != purpose {
+		return nil, errors.New("Invalid authentication token")
+	}
+	return claims, nil
+}
+
+func Authenticate(req *http.Request) (*AccessToken, error) {
+	authHeader := req.Header.Get("Authorization")
+	if authHeader == "" {
+        return nil, errors.New("No authentication token in header")
     }
+	jwtToken := strings.TrimPrefix(authHeader, "Bearer ")
+
+	claims, err := ParseToken(jwtToken, PurposeAccess)
+	if err != nil {
+		return nil, err
+	}
+
+	username, ok := claims["username"].(string)
+	if !ok {
+		return nil, errors.New("Invalid authentication token")
+	}
+	sessionId, ok := claims["sid"].(string)
+	if !ok {
+		return nil, errors.New("Invalid authentication token")
+	}
 
-	username := claims["username"].(string)
-	return username, nil
+	return &AccessToken{
+		Username:  username,
+		SessionId: sessionId,
+	}, nil
 }
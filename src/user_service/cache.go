@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// TTLCache keeps values for a short time, so hot lookups such as the user
+// of every authenticated request do not hit the database every time.
+// A zero TTL disables caching.
+type TTLCache[V any] struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry[V]
+}
+
+func NewTTLCache[V any](ttl time.Duration) *TTLCache[V] {
+	return &TTLCache[V]{
+		ttl:     ttl,
+		entries: map[string]cacheEntry[V]{},
+	}
+}
+
+func (c *TTLCache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+func (c *TTLCache[V]) Put(key string, value V) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry[V]{
+		value:   value,
+		expires: now.Add(c.ttl),
+	}
+}
+
+func (c *TTLCache[V]) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+func (c *TTLCache[V]) InvalidateFunc(match func(key string, value V) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, entry := range c.entries {
+		if match(k, entry.value) {
+			delete(c.entries, k)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	ConfigFile string
+
+	Port           int
+	InternalPort   int
+	PrivateKeyFile string
+	PublicKeyFile  string
+	PublicURL      string
+
+	DBHost     string
+	DBPort     int
+	DBName     string
+	DBUsername string
+	DBPassword string
+
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+	DBConnMaxIdleTime time.Duration
+	DBConnectTimeout  time.Duration
+	DBRetryAttempts   int
+
+	PostServerAddr string
+	PostServerCA   string
+	PostServerCert string
+	PostServerKey  string
+	PostServerName string
+
+	PostServerTimeout         time.Duration
+	PostServerBreakerFailures int
+	PostServerBreakerCooldown time.Duration
+
+	KafkaURL            string
+	StatisticsServerURL     string
+	StatisticsServerTimeout time.Duration
+
+	KafkaRequiredAcks  string
+	KafkaBatchSize     int
+	KafkaBatchTimeout  time.Duration
+	KafkaCompression   string
+	KafkaAsync         bool
+	KafkaSpoolDir      string
+	KafkaSpoolMaxBytes int64
+	KafkaSpoolInterval time.Duration
+
+	ExportDir   string
+	MailDir     string
+	Admins       string
+	MaxBodySize  int64
+	MaxFollowing int
+
+	PasswordResetTTL     time.Duration
+	MFATokenTTL          time.Duration
+	EmailVerificationTTL time.Duration
+	RequireVerifiedEmail bool
+	ExportLinkTTL        time.Duration
+	ExportRetention      time.Duration
+	ExportTimeout        time.Duration
+	ExportConcurrency    int
+	UserCacheTTL         time.Duration
+
+	DeletionRetryInterval time.Duration
+
+	LoginThrottleStore  string
+	LoginFreeAttempts   int
+	LoginIPFreeAttempts int
+	LoginBaseDelay      time.Duration
+	LoginMaxDelay       time.Duration
+	LoginWindow         time.Duration
+
+	RateLimitStore string
+	RateLimits     string
+
+	IdempotencyStore string
+	IdempotencyTTL   time.Duration
+
+	LogLevel        string
+	TracingExporter string
+	OTLPEndpoint    string
+	ShutdownTimeout time.Duration
+}
+
+// envPrefix starts the environment variables of the settings, e.g.
+// USER_SERVICE_KAFKA_URL.
+const envPrefix = "USER_SERVICE_"
+
+// secretSettings are never printed. Like every setting they can be read from
+// a file named by the USER_SERVICE_<NAME>_FILE environment variable.
+var secretSettings = map[string]bool{
+	"db-password": true,
+}
+
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "config", "", "YAML `file` with settings named like the flags, USER_SERVICE_CONFIG_FILE is used if empty")
+
+	fs.IntVar(&c.Port, "port", 8080, "http server port")
+	fs.IntVar(&c.InternalPort, "internal-port", 8081, "port of the HTTP server with /metrics, never publish it")
+	fs.StringVar(&c.PrivateKeyFile, "private", "", "path to JWT private key `file`")
+	fs.StringVar(&c.PublicKeyFile, "public", "", "path to JWT public key `file`")
+	fs.StringVar(&c.PublicURL, "public-url", "http://localhost:8080", "base URL under which clients reach this service, used in links")
+
+	fs.StringVar(&c.DBHost, "db-host", "", "hostname of the database")
+	fs.IntVar(&c.DBPort, "db-port", 5432, "port of the database")
+	fs.StringVar(&c.DBName, "db-name", "", "database name")
+	fs.StringVar(&c.DBUsername, "db-username", "", "database user")
+	fs.StringVar(&c.DBPassword, "db-password", "", "database password, prefer USER_SERVICE_DB_PASSWORD_FILE")
+
+	fs.IntVar(&c.DBMaxOpenConns, "db-max-open-conns", 25, "most open database connections, 0 means unlimited")
+	fs.IntVar(&c.DBMaxIdleConns, "db-max-idle-conns", 10, "most idle database connections kept for reuse")
+	fs.DurationVar(&c.DBConnMaxLifetime, "db-conn-max-lifetime", 30*time.Minute, "how long a database connection is reused at most, 0 means forever")
+	fs.DurationVar(&c.DBConnMaxIdleTime, "db-conn-max-idle-time", 5*time.Minute, "how long a database connection may stay idle, 0 means forever")
+	fs.DurationVar(&c.DBConnectTimeout, "db-connect-timeout", 30*time.Second, "how long startup waits for the database")
+	fs.IntVar(&c.DBRetryAttempts, "db-retry-attempts", 3, "attempts for queries and transactions that fail with a transient error")
+
+	fs.StringVar(&c.PostServerAddr, "post-server-addr", "", "comma-separated addresses of the gRPC post servers, calls are balanced round robin")
+	fs.StringVar(&c.PostServerCA, "post-server-ca", "", "path to CA `file` used to verify the post server, enables TLS")
+	fs.StringVar(&c.PostServerCert, "post-server-cert", "", "path to client certificate `file` presented to the post server, enables TLS")
+	fs.StringVar(&c.PostServerKey, "post-server-key", "", "path to client private key `file`")
+	fs.StringVar(&c.PostServerName, "post-server-name", "", "expected name in the post server certificate, defaults to the host of the first address")
+	fs.DurationVar(&c.PostServerTimeout, "post-server-timeout", 5*time.Second, "deadline of a single call to the post server")
+	fs.IntVar(&c.PostServerBreakerFailures, "post-server-breaker-failures", 5, "failed calls in a row after which calls to the post server fail fast")
+	fs.DurationVar(&c.PostServerBreakerCooldown, "post-server-breaker-cooldown", 10*time.Second, "how long calls fail fast before the post server is tried again")
+
+	fs.StringVar(&c.KafkaURL, "kafka-url", "", "address of the Kafka")
+	fs.StringVar(&c.KafkaRequiredAcks, "kafka-required-acks", "all", "acknowledgements Kafka must give for a write: none, one or all")
+	fs.IntVar(&c.KafkaBatchSize, "kafka-batch-size", 100, "most messages sent to Kafka in one request")
+	fs.DurationVar(&c.KafkaBatchTimeout, "kafka-batch-timeout", 10*time.Millisecond, "how long messages wait for a batch to fill up")
+	fs.StringVar(&c.KafkaCompression, "kafka-compression", "none", "compression of Kafka messages: none, gzip, snappy, lz4 or zstd")
+	fs.BoolVar(&c.KafkaAsync, "kafka-async", false, "spool likes and views on disk and send them in the background, so requests do not wait for Kafka")
+	fs.StringVar(&c.KafkaSpoolDir, "kafka-spool-dir", filepath.Join(os.TempDir(), "kafka-spool"), "`directory` where events wait for Kafka in async mode")
+	fs.Int64Var(&c.KafkaSpoolMaxBytes, "kafka-spool-max-bytes", 256<<20, "size at which the spool refuses new events, 0 means unlimited")
+	fs.DurationVar(&c.KafkaSpoolInterval, "kafka-spool-interval", time.Second, "how often spooled events are sent to Kafka")
+	fs.StringVar(&c.StatisticsServerURL, "statistics-server-url", "", "base URL of the internal port of the statistics service")
+	fs.DurationVar(&c.StatisticsServerTimeout, "statistics-server-timeout", 10*time.Second, "deadline of a single call to the statistics service")
+
+	fs.StringVar(&c.ExportDir, "export-dir", filepath.Join(os.TempDir(), "exports"), "`directory` where personal data exports are stored")
+	fs.StringVar(&c.MailDir, "mail-dir", "", "`directory` where outgoing mail is stored, mail is only logged if empty")
+	fs.StringVar(&c.Admins, "admins", "", "comma-separated usernames of existing accounts that `user_service promote-admins` makes admins")
+	fs.Int64Var(&c.MaxBodySize, "max-body-size", 1<<20, "largest accepted JSON request body in bytes")
+	fs.IntVar(&c.MaxFollowing, "max-following", 5000, "most users one user may follow, post_service gets the whole list with every request")
+
+	fs.DurationVar(&c.PasswordResetTTL, "password-reset-ttl", time.Hour, "how long password reset tokens stay valid")
+	fs.DurationVar(&c.MFATokenTTL, "mfa-token-ttl", 5*time.Minute, "how long the token between the two login steps stays valid")
+	fs.DurationVar(&c.EmailVerificationTTL, "email-verification-ttl", 24*time.Hour, "how long email verification links stay valid")
+	fs.BoolVar(&c.RequireVerifiedEmail, "require-verified-email", false, "allow creating posts only with a verified email")
+	fs.DurationVar(&c.ExportLinkTTL, "export-link-ttl", 15*time.Minute, "how long export download links stay valid")
+	fs.DurationVar(&c.ExportRetention, "export-retention", 24*time.Hour, "how long finished exports are kept before their archives are deleted")
+	fs.DurationVar(&c.ExportTimeout, "export-timeout", 10*time.Minute, "how long an export may wait and run before it fails")
+	fs.IntVar(&c.ExportConcurrency, "export-concurrency", 4, "exports built at the same time, further ones wait")
+	fs.DurationVar(&c.UserCacheTTL, "user-cache-ttl", 10*time.Second, "how long authenticated users, sessions and follow lists are cached, 0 disables the cache")
+
+	fs.DurationVar(&c.DeletionRetryInterval, "deletion-retry-interval", time.Minute, "how often unfinished account deletions are published again")
+
+	fs.StringVar(&c.LoginThrottleStore, "login-throttle-store", "memory", "where failed login attempts are counted: memory or postgres, the latter is shared by all replicas")
+	fs.IntVar(&c.LoginFreeAttempts, "login-free-attempts", 5, "failed logins per username before it gets locked out")
+	fs.IntVar(&c.LoginIPFreeAttempts, "login-ip-free-attempts", 20, "failed logins per client address before it gets locked out")
+	fs.DurationVar(&c.LoginBaseDelay, "login-base-delay", time.Second, "first lockout, it doubles with every further failure")
+	fs.DurationVar(&c.LoginMaxDelay, "login-max-delay", 15*time.Minute, "longest lockout")
+	fs.DurationVar(&c.LoginWindow, "login-attempts-window", time.Hour, "how long failed logins are remembered")
+
+	fs.StringVar(&c.RateLimitStore, "rate-limit-store", "memory", "where rate limit buckets are kept: memory or postgres, the latter is shared by all replicas")
+	fs.StringVar(&c.RateLimits, "rate-limits", "createPost=10/1m,like=60/1m,view=120/1m", "comma-separated `route=limit/period` quotas per user or client address, routes without one are unlimited")
+
+	fs.StringVar(&c.IdempotencyStore, "idempotency-store", "memory", "where responses for idempotency keys are kept: memory or postgres, the latter is shared by all replicas")
+	fs.DurationVar(&c.IdempotencyTTL, "idempotency-ttl", 24*time.Hour, "how long responses are replayed for a repeated idempotency key")
+
+	fs.StringVar(&c.LogLevel, "log-level", "info", "lowest level that is logged: debug, info, warn or error")
+	fs.StringVar(&c.TracingExporter, "tracing-exporter", "none", "where spans are sent: none, stdout or otlp")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", "", "URL of the OTLP gRPC collector, e.g. http://jaeger:4317, defaults to OTEL_EXPORTER_OTLP_ENDPOINT")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 15*time.Second, "how long in-flight requests and background work may take to finish on shutdown")
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	require := func(value string, name string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+	oneOf := func(value string, name string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		errs = append(errs, fmt.Errorf("%s must be one of %s", name, strings.Join(allowed, ", ")))
+	}
+	positive := func(value int64, name string) {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", name))
+		}
+	}
+	notNegative := func(value int64, name string) {
+		if value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", name))
+		}
+	}
+
+	positive(int64(c.Port), "port")
+	positive(int64(c.InternalPort), "internal-port")
+	if c.InternalPort == c.Port {
+		errs = append(errs, errors.New("internal-port must differ from port"))
+	}
+	require(c.PrivateKeyFile, "private")
+	require(c.PublicKeyFile, "public")
+	require(c.DBHost, "db-host")
+	positive(int64(c.DBPort), "db-port")
+	require(c.DBName, "db-name")
+	require(c.DBUsername, "db-username")
+	require(c.DBPassword, "db-password")
+	notNegative(int64(c.DBMaxOpenConns), "db-max-open-conns")
+	notNegative(int64(c.DBMaxIdleConns), "db-max-idle-conns")
+	notNegative(int64(c.DBConnMaxLifetime), "db-conn-max-lifetime")
+	notNegative(int64(c.DBConnMaxIdleTime), "db-conn-max-idle-time")
+	positive(int64(c.DBConnectTimeout), "db-connect-timeout")
+	positive(int64(c.DBRetryAttempts), "db-retry-attempts")
+	require(c.PostServerAddr, "post-server-addr")
+	positive(int64(c.PostServerTimeout), "post-server-timeout")
+	positive(int64(c.PostServerBreakerFailures), "post-server-breaker-failures")
+	positive(int64(c.PostServerBreakerCooldown), "post-server-breaker-cooldown")
+	require(c.KafkaURL, "kafka-url")
+	oneOf(c.KafkaRequiredAcks, "kafka-required-acks", "none", "one", "all")
+	positive(int64(c.KafkaBatchSize), "kafka-batch-size")
+	positive(int64(c.KafkaBatchTimeout), "kafka-batch-timeout")
+	oneOf(c.KafkaCompression, "kafka-compression", "none", "gzip", "snappy", "lz4", "zstd")
+	if c.KafkaAsync {
+		require(c.KafkaSpoolDir, "kafka-spool-dir")
+		notNegative(c.KafkaSpoolMaxBytes, "kafka-spool-max-bytes")
+		positive(int64(c.KafkaSpoolInterval), "kafka-spool-interval")
+	}
+	require(c.StatisticsServerURL, "statistics-server-url")
+	positive(int64(c.StatisticsServerTimeout), "statistics-server-timeout")
+	if c.PostServerCert != "" && c.PostServerKey == "" {
+		errs = append(errs, errors.New("post-server-key is required with post-server-cert"))
+	}
+	positive(c.MaxBodySize, "max-body-size")
+	positive(int64(c.MaxFollowing), "max-following")
+	if c.MaxFollowing > maxFollowingLimit {
+		errs = append(errs, fmt.Errorf("max-following must not exceed %d, post_service binds the list as query parameters", maxFollowingLimit))
+	}
+	positive(int64(c.ExportRetention), "export-retention")
+	positive(int64(c.ExportTimeout), "export-timeout")
+	positive(int64(c.ExportConcurrency), "export-concurrency")
+
+	oneOf(c.LoginThrottleStore, "login-throttle-store", "memory", "postgres")
+	oneOf(c.RateLimitStore, "rate-limit-store", "memory", "postgres")
+	oneOf(c.IdempotencyStore, "idempotency-store", "memory", "postgres")
+	_, err := ParseQuotas(c.RateLimits)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("rate-limits: %w", err))
+	}
+
+	var level slog.Level
+	err = level.UnmarshalText([]byte(c.LogLevel))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("log-level: %w", err))
+	}
+	oneOf(c.TracingExporter, "tracing-exporter", "none", "stdout", "otlp")
+
+	return errors.Join(errs...)
+}
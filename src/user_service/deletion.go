@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/segmentio/kafka-go"
+
+	"common/logging"
+	"common/metrics"
+)
+
+const (
+	UserDeletedEvent = "user.deleted"
+
+	PostService       = "post_service"
+	StatisticsService = "statistics_service"
+)
+
+type UserEvent struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+}
+
+// DeletionProgress is reported by a service once it has removed the data
+// of a deleted user.
+type DeletionProgress struct {
+	Username string `json:"username"`
+	Service  string `json:"service"`
+}
+
+var kafkaUserEventWriter *kafka.Writer
+
+func PublishUserDeleted(ctx context.Context, username string) error {
+	msg, err := json.Marshal(UserEvent{
+		Type:     UserDeletedEvent,
+		Username: username,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE accountDeletions SET lastAttemptAt=now() WHERE username=$1", username)
+	if err != nil {
+		return err
+	}
+
+	return metrics.WriteKafka(ctx, kafkaUserEventWriter, kafka.Message{
+		Key:   []byte(username),
+		Value: msg,
+	})
+}
+
+// RetryAccountDeletions publishes user.deleted again for deletions that some
+// service has not confirmed yet. Services handle the event idempotently, so
+// a deletion is eventually finished even if an event or a report was lost.
+func RetryAccountDeletions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		rows, err := db.QueryContext(ctx, "SELECT username FROM accountDeletions WHERE completedAt IS NULL AND lastAttemptAt < $1",
+			time.Now().Add(-interval))
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to list pending account deletions", "error", err)
+			continue
+		}
+
+		var usernames []string
+		for rows.Next() {
+			var username string
+			err = rows.Scan(&username)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to list pending account deletions", "error", err)
+				break
+			}
+			usernames = append(usernames, username)
+		}
+		rows.Close()
+
+		for _, username := range usernames {
+			err = PublishUserDeleted(ctx, username)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to publish account deletion", "user", username, "error", err)
+			}
+		}
+	}
+}
+
+func ConsumeDeletionProgress(ctx context.Context, kafkaURL string) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: []string{kafkaURL},
+		Topic:   "user-deletion-progress",
+		GroupID: "user_service",
+	})
+	defer reader.Close()
+
+	for {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			metrics.KafkaConsumeErrors.WithLabelValues(reader.Config().Topic, "read").Inc()
+			slog.ErrorContext(ctx, "Failed to read message from Kafka", "topic", reader.Config().Topic, "error", err)
+			continue
+		}
+		metrics.ObserveKafkaRead(reader)
+		msgCtx := logging.WithMessageRequestID(ctx, &msg)
+
+		var progress DeletionProgress
+		err = json.Unmarshal(msg.Value, &progress)
+		if err != nil {
+			metrics.KafkaConsumeErrors.WithLabelValues(reader.Config().Topic, "decode").Inc()
+			slog.ErrorContext(msgCtx, "Failed to deserialize message", "topic", msg.Topic, "error", err)
+			continue
+		}
+
+		var column string
+		switch progress.Service {
+		case PostService:
+			column = "postsDoneAt"
+		case StatisticsService:
+			column = "statisticsDoneAt"
+		default:
+			slog.WarnContext(msgCtx, "Unknown service in deletion progress", "user", progress.Username, "reporter", progress.Service)
+			continue
+		}
+
+		_, err = db.Exec("UPDATE accountDeletions SET "+column+"=COALESCE("+column+", now()) WHERE username=$1",
+			progress.Username)
+		if err != nil {
+			metrics.KafkaConsumeErrors.WithLabelValues(reader.Config().Topic, "process").Inc()
+			slog.ErrorContext(msgCtx, "Failed to record deletion progress", "user", progress.Username, "reporter", progress.Service, "error", err)
+			continue
+		}
+
+		_, err = db.Exec(`
+			UPDATE accountDeletions SET completedAt=now()
+			WHERE username=$1 AND completedAt IS NULL AND postsDoneAt IS NOT NULL AND statisticsDoneAt IS NOT NULL
+		`, progress.Username)
+		if err != nil {
+			metrics.KafkaConsumeErrors.WithLabelValues(reader.Config().Topic, "process").Inc()
+			slog.ErrorContext(msgCtx, "Failed to complete account deletion", "user", progress.Username, "error", err)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+
+	pb "user_service/proto"
+)
+
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportDone    = "done"
+	ExportFailed  = "failed"
+
+	exportPageSize = 100
+)
+
+var exportDir string
+var exportLinkTTL time.Duration
+
+const exportInterrupted = "Interrupted by a restart"
+var publicURL string
+var statisticsServiceURL string
+var statisticsClient = &http.Client{Timeout: 10 * time.Second}
+
+// exportJobs lets shutdown wait for running exports.
+var exportJobs sync.WaitGroup
+
+// exportSlots bounds the exports built at the same time, exportTimeout how
+// long one may wait for a slot and run.
+var exportSlots = make(chan struct{}, 4)
+var exportTimeout = 10 * time.Minute
+
+type ExportJob struct {
+	Id          string     `json:"jobId"`
+	Status      string     `json:"status"`
+	Progress    int        `json:"progress"`
+	Error       string     `json:"error,omitempty"`
+	DownloadUrl string     `json:"downloadUrl,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+}
+
+type ExportedUser struct {
+	Id          uint64    `json:"id"`
+	Username    string    `json:"username"`
+	FirstName   *string   `json:"firstName"`
+	LastName    *string   `json:"lastName"`
+	DateOfBirth *string   `json:"dateOfBirth"`
+	Mail        *string   `json:"email"`
+	Phone       *string   `json:"phone"`
+	Role        Role      `json:"role"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type ExportedActivity struct {
+	Likes []uint64 `json:"likes"`
+	Views []uint64 `json:"views"`
+}
+
+func StartExport(w http.ResponseWriter, req *http.Request) {
+	principal := CurrentPrincipal(req)
+
+	jobId, err := NewRandomId()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec("INSERT INTO exportJobs(id, userId, status) VALUES($1, $2, $3)", jobId, principal.Id, ExportPending)
+	if isUniqueViolation(err) {
+		http.Error(w, "An export is already in progress", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create export: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	exportJobs.Add(1)
+	go func() {
+		defer exportJobs.Done()
+		RunExport(jobId, principal)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(ExportJob{
+		Id:     jobId,
+		Status: ExportPending,
+	})
+}
+
+func GetExport(w http.ResponseWriter, req *http.Request) {
+	principal := CurrentPrincipal(req)
+	jobId := mux.Vars(req)["jobId"]
+
+	job := ExportJob{Id: jobId}
+	var jobError sql.NullString
+	err := db.QueryRow("SELECT status, progress, error FROM exportJobs WHERE id=$1 AND userId=$2", jobId, principal.Id).
+		Scan(&job.Status, &job.Progress, &jobError)
+	if err != nil {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	job.Error = jobError.String
+
+	if job.Status == ExportDone {
+		expiresAt := time.Now().Add(exportLinkTTL)
+		token, err := SignToken(PurposeExport, jwt.MapClaims{
+			"job": jobId,
+			"exp": expiresAt.Unix(),
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error signing link: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		job.DownloadUrl = fmt.Sprintf("%s/user/export/download?token=%s", publicURL, url.QueryEscape(token))
+		job.ExpiresAt = &expiresAt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// DownloadExport is public: the signed link itself grants access.
+func DownloadExport(w http.ResponseWriter, req *http.Request) {
+	claims, err := ParseToken(req.URL.Query().Get("token"), PurposeExport)
+	if err != nil {
+		http.Error(w, "Invalid or expired link", http.StatusForbidden)
+		return
+	}
+	jobId, ok := claims["job"].(string)
+	if !ok {
+		http.Error(w, "Invalid or expired link", http.StatusForbidden)
+		return
+	}
+
+	var path string
+	err = db.QueryRow(`
+		SELECT exportJobs.path FROM exportJobs JOIN users ON users.id = exportJobs.userId
+		WHERE exportJobs.id=$1 AND exportJobs.status=$2 AND users.deletedAt IS NULL
+	`, jobId, ExportDone).Scan(&path)
+	if err != nil {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"export-%s.zip\"", jobId))
+	io.Copy(w, file)
+}
+
+func setExportProgress(jobId string, status string, progress int) {
+	_, err := db.Exec("UPDATE exportJobs SET status=$1, progress=$2 WHERE id=$3", status, progress, jobId)
+	if err != nil {
+		slog.Error("Failed to update export", "job_id", jobId, "error", err)
+	}
+}
+
+func RunExport(jobId string, principal *Principal) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	path, err := buildExport(ctx, jobId, principal)
+	if err != nil {
+		slog.Error("Export failed", "job_id", jobId, "error", err)
+		_, err = db.Exec("UPDATE exportJobs SET status=$1, error=$2, finishedAt=now() WHERE id=$3",
+			ExportFailed, err.Error(), jobId)
+		if err != nil {
+			slog.Error("Failed to update export", "job_id", jobId, "error", err)
+		}
+		return
+	}
+
+	// The job is gone if the account was deleted meanwhile, and so must be
+	// the archive.
+	result, err := db.Exec("UPDATE exportJobs SET status=$1, progress=100, path=$2, finishedAt=now() WHERE id=$3",
+		ExportDone, path, jobId)
+	if err != nil {
+		slog.Error("Failed to update export", "job_id", jobId, "error", err)
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		removeExportArchive(path)
+	}
+}
+
+func buildExport(ctx context.Context, jobId string, principal *Principal) (string, error) {
+	select {
+	case exportSlots <- struct{}{}:
+		defer func() { <-exportSlots }()
+	case <-ctx.Done():
+		return "", fmt.Errorf("Failed to start export: %w", ctx.Err())
+	}
+	setExportProgress(jobId, ExportRunning, 0)
+
+	user, err := exportUser(ctx, principal.Id)
+	if err != nil {
+		return "", fmt.Errorf("Failed to export user: %w", err)
+	}
+	following, err := LoadFollowing(ctx, principal.Id)
+	if err != nil {
+		return "", fmt.Errorf("Failed to export following: %w", err)
+	}
+	setExportProgress(jobId, ExportRunning, 20)
+
+	posts, err := exportPosts(ctx, principal.Username)
+	if err != nil {
+		return "", fmt.Errorf("Failed to export posts: %w", err)
+	}
+	setExportProgress(jobId, ExportRunning, 40)
+
+	revisions, err := exportRevisions(ctx, principal.Username, posts)
+	if err != nil {
+		return "", fmt.Errorf("Failed to export revisions: %w", err)
+	}
+	setExportProgress(jobId, ExportRunning, 60)
+
+	activity, err := exportActivity(ctx, principal.Username)
+	if err != nil {
+		return "", fmt.Errorf("Failed to export statistics: %w", err)
+	}
+	setExportProgress(jobId, ExportRunning, 90)
+
+	err = os.MkdirAll(exportDir, 0700)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(exportDir, jobId+".zip")
+	err = writeExportArchive(path, map[string]interface{}{
+		"user.json":      user,
+		"following.json": following,
+		"posts.json":     posts,
+		"revisions.json": revisions,
+		"activity.json":  activity,
+	})
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("Failed to write archive: %w", err)
+	}
+	return path, nil
+}
+
+func exportUser(ctx context.Context, userId uint64) (*ExportedUser, error) {
+	user := &ExportedUser{}
+	var firstName, lastName, dateOfBirth, mail, phone sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT id, username, firstName, lastName, dateOfBirth, mail, phone, role, createdAt
+		FROM users WHERE id=$1
+	`, userId).Scan(&user.Id, &user.Username, &firstName, &lastName, &dateOfBirth, &mail, &phone, &user.Role, &user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	nullable := func(s sql.NullString) *string {
+		if !s.Valid {
+			return nil
+		}
+		return &s.String
+	}
+	user.FirstName = nullable(firstName)
+	user.LastName = nullable(lastName)
+	user.DateOfBirth = nullable(dateOfBirth)
+	user.Mail = nullable(mail)
+	user.Phone = nullable(phone)
+	return user, nil
+}
+
+// exportPosts also returns the deleted posts that are still kept, they have
+// DeletedAt set.
+func exportPosts(ctx context.Context, username string) ([]*pb.Post, error) {
+	posts := []*pb.Post{}
+	for _, deleted := range []bool{false, true} {
+		for offset := uint64(0); ; offset += exportPageSize {
+			resp, err := postServiceClient.ListPosts(ctx, &pb.ListPostsRequest{
+				Limit:    exportPageSize,
+				Offset:   offset,
+				Username: username,
+				Deleted:  deleted,
+				// The export holds every post of the user, private ones too.
+				Viewer: &pb.Viewer{Username: username},
+			})
+			if err != nil {
+				return nil, err
+			}
+			posts = append(posts, resp.Posts...)
+			if len(resp.Posts) < exportPageSize {
+				break
+			}
+		}
+	}
+	return posts, nil
+}
+
+// exportRevisions returns the earlier versions of posts. post_service only
+// serves revisions of posts that are not deleted, so those of deleted posts
+// are left out.
+func exportRevisions(ctx context.Context, username string, posts []*pb.Post) ([]*pb.PostRevision, error) {
+	revisions := []*pb.PostRevision{}
+	for _, post := range posts {
+		if post.DeletedAt != 0 {
+			continue
+		}
+		for offset := uint64(0); ; offset += exportPageSize {
+			resp, err := postServiceClient.ListPostRevisions(ctx, &pb.ListPostRevisionsRequest{
+				PostId: post.Id,
+				Limit:  exportPageSize,
+				Offset: offset,
+				Viewer: &pb.Viewer{Username: username},
+			})
+			if err != nil {
+				return nil, err
+			}
+			revisions = append(revisions, resp.Revisions...)
+			if len(resp.Revisions) < exportPageSize {
+				break
+			}
+		}
+	}
+	return revisions, nil
+}
+
+func exportActivity(ctx context.Context, username string) (*ExportedActivity, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("%s/users/%s/activity", statisticsServiceURL, url.PathEscape(username)), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := statisticsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	activity := &ExportedActivity{}
+	err = json.NewDecoder(resp.Body).Decode(activity)
+	if err != nil {
+		return nil, err
+	}
+	return activity, nil
+}
+
+func writeExportArchive(path string, files map[string]interface{}) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+	for name, content := range files {
+		entry, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(entry)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(content)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func removeExportArchive(path string) error {
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// deleteExports removes the archives and jobs matched by condition, a
+// WHERE clause over exportJobs.
+func deleteExports(ctx context.Context, condition string, args ...interface{}) (int, error) {
+	rows, err := db.QueryContext(ctx, "DELETE FROM exportJobs WHERE "+condition+" RETURNING id, path", args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	deleted := 0
+	var errs []error
+	for rows.Next() {
+		var jobId string
+		var path sql.NullString
+		err = rows.Scan(&jobId, &path)
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+		// Running jobs have no path yet, their archive is named after them.
+		if !path.Valid {
+			path.String = filepath.Join(exportDir, jobId+".zip")
+		}
+		err = removeExportArchive(path.String)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, rows.Err())
+	return deleted, errors.Join(errs...)
+}
+
+// DeleteUserExports removes every export of a user, finished or not.
+func DeleteUserExports(ctx context.Context, userId uint64) error {
+	_, err := deleteExports(ctx, "userId=$1", userId)
+	return err
+}
+
+// FailInterruptedExports marks exports that were still running when the
+// service stopped as failed, nothing else would ever finish them.
+func FailInterruptedExports(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE exportJobs SET status=$1, error=$2, finishedAt=now()
+		WHERE status IN ($3, $4)
+		RETURNING id
+	`, ExportFailed, exportInterrupted, ExportPending, ExportRunning)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var jobId string
+		err = rows.Scan(&jobId)
+		if err != nil {
+			return err
+		}
+		slog.WarnContext(ctx, "Export was interrupted", "job_id", jobId)
+		err = removeExportArchive(filepath.Join(exportDir, jobId+".zip"))
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// PurgeExports deletes exports that finished more than retention ago, their
+// archives included, until ctx is cancelled.
+func PurgeExports(ctx context.Context, retention time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deleted, err := deleteExports(ctx, "finishedAt < $1", time.Now().Add(-retention))
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to purge exports", "error", err)
+		}
+		if deleted > 0 {
+			slog.InfoContext(ctx, "Purged exports", "count", deleted)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	"github.com/gorilla/mux"
+
+	"common/database"
+	pb "user_service/proto"
+)
+
+// maxFollowingLimit keeps the follow list sent to post_service well below
+// the 65535 bind parameters PostgreSQL accepts in one query.
+const maxFollowingLimit = 50000
+
+// maxFollowing bounds the follow list of a user, which is loaded and sent to
+// post_service with every request.
+var maxFollowing = 5000
+
+var errFollowingLimit = errors.New("following limit reached")
+
+// followingCache keeps the follow list of a user id for RequestViewer, which
+// runs for every post read. Changes made through this replica invalidate it,
+// other replicas catch up within the TTL.
+var followingCache = NewTTLCache[[]string](0)
+
+func FollowUser(w http.ResponseWriter, req *http.Request) {
+	principal := CurrentPrincipal(req)
+	username := mux.Vars(req)["username"]
+	if strings.EqualFold(username, principal.Username) {
+		http.Error(w, "Cannot follow yourself", http.StatusBadRequest)
+		return
+	}
+
+	err := database.RunInTx(req.Context(), db, func(tx *sql.Tx) error {
+		// Serializes the follows of one user so the limit cannot be overrun.
+		_, err := tx.ExecContext(req.Context(), "SELECT 1 FROM users WHERE id=$1 FOR UPDATE", principal.Id)
+		if err != nil {
+			return err
+		}
+
+		var followeeId uint64
+		err = tx.QueryRowContext(req.Context(), "SELECT id FROM users WHERE lower(username)=lower($1) AND deletedAt IS NULL", username).
+			Scan(&followeeId)
+		if err != nil {
+			return err
+		}
+
+		var following int
+		var followed bool
+		err = tx.QueryRowContext(req.Context(), `
+			SELECT count(*), coalesce(bool_or(followeeId=$2), false) FROM follows WHERE followerId=$1
+		`, principal.Id, followeeId).Scan(&following, &followed)
+		if err != nil {
+			return err
+		}
+		if followed {
+			return nil
+		}
+		if following >= maxFollowing {
+			return errFollowingLimit
+		}
+
+		_, err = tx.ExecContext(req.Context(), `
+			INSERT INTO follows(followerId, followeeId) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, principal.Id, followeeId)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err == errFollowingLimit {
+		http.Error(w, fmt.Sprintf("Cannot follow more than %d users", maxFollowing), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to follow user: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	followingCache.Invalidate(strconv.FormatUint(principal.Id, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func UnfollowUser(w http.ResponseWriter, req *http.Request) {
+	principal := CurrentPrincipal(req)
+	username := mux.Vars(req)["username"]
+
+	_, err := db.ExecContext(req.Context(), `
+		DELETE FROM follows
+		WHERE followerId=$1 AND followeeId=(SELECT id FROM users WHERE lower(username)=lower($2))
+	`, principal.Id, username)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to unfollow user: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	followingCache.Invalidate(strconv.FormatUint(principal.Id, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func ListFollowing(w http.ResponseWriter, req *http.Request) {
+	following, err := LoadFollowing(req.Context(), CurrentPrincipal(req).Id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list followed users: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(following)
+}
+
+// LoadFollowing returns the usernames the user follows, leaving out deleted
+// users. At most maxFollowing are returned, even for follows made before the
+// limit was lowered.
+func LoadFollowing(ctx context.Context, userId uint64) ([]string, error) {
+	var following []string
+	err := database.Retry(ctx, func() error {
+		rows, err := db.QueryContext(ctx, `
+			SELECT users.username FROM follows JOIN users ON users.id = follows.followeeId
+			WHERE follows.followerId=$1 AND users.deletedAt IS NULL
+			ORDER BY users.username
+			LIMIT $2
+		`, userId, maxFollowing)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		following = []string{}
+		for rows.Next() {
+			var username string
+			err = rows.Scan(&username)
+			if err != nil {
+				return err
+			}
+			following = append(following, username)
+		}
+		return rows.Err()
+	})
+	return following, err
+}
+
+// RequestViewer describes the caller to post_service, which decides from it
+// which posts are visible. Anonymous requests have no viewer.
+func RequestViewer(req *http.Request) (*pb.Viewer, error) {
+	principal := CurrentPrincipal(req)
+	if principal == nil {
+		return nil, nil
+	}
+
+	key := strconv.FormatUint(principal.Id, 10)
+	following, ok := followingCache.Get(key)
+	if !ok {
+		var err error
+		following, err = LoadFollowing(req.Context(), principal.Id)
+		if err != nil {
+			return nil, err
+		}
+		followingCache.Put(key, following)
+	}
+	return &pb.Viewer{
+		Username:  principal.Username,
+		Role:      string(principal.Role),
+		Following: following,
+	}, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	pb "user_service/proto"
+)
+
+func CheckPostgres(ctx context.Context) error {
+	return db.PingContext(ctx)
+}
+
+// CheckPostService asks post_service for its own health, so a reachable but
+// broken instance counts as down too.
+func CheckPostService(ctx context.Context) error {
+	resp, err := healthpb.NewHealthClient(postServiceConn).Check(ctx, &healthpb.HealthCheckRequest{
+		Service: pb.PostService_ServiceDesc.ServiceName,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("post service is %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	// A request that takes longer than this is considered crashed and its
+	// key can be used again.
+	idempotencyLockTimeout = time.Minute
+)
+
+var (
+	ErrIdempotencyInProgress = errors.New("A request with this idempotency key is still in progress")
+	ErrIdempotencyMismatch   = errors.New("The idempotency key was already used for a different request")
+)
+
+type StoredResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+type IdempotencyStore interface {
+	// Begin reserves the key for a request with the given fingerprint. It
+	// returns the stored response if the key was already completed.
+	Begin(ctx context.Context, key string, fingerprint string) (*StoredResponse, error)
+	// Complete stores the response, it is replayed until ttl passes.
+	Complete(ctx context.Context, key string, resp StoredResponse, ttl time.Duration) error
+	// Release frees the key without storing anything, so the request can be
+	// retried.
+	Release(ctx context.Context, key string) error
+	Purge(ctx context.Context) error
+}
+
+type idempotencyEntry struct {
+	fingerprint string
+	resp        *StoredResponse
+	expiresAt   time.Time
+}
+
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{entries: map[string]*idempotencyEntry{}}
+}
+
+func (s *MemoryIdempotencyStore) Begin(ctx context.Context, key string, fingerprint string) (*StoredResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if ok && time.Now().Before(entry.expiresAt) {
+		if entry.fingerprint != fingerprint {
+			return nil, ErrIdempotencyMismatch
+		}
+		if entry.resp == nil {
+			return nil, ErrIdempotencyInProgress
+		}
+		return entry.resp, nil
+	}
+
+	s.entries[key] = &idempotencyEntry{
+		fingerprint: fingerprint,
+		expiresAt:   time.Now().Add(idempotencyLockTimeout),
+	}
+	return nil, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(ctx context.Context, key string, resp StoredResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	entry.resp = &resp
+	entry.expiresAt = time.Now().Add(ttl)
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Purge(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range s.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
+
+// PostgresIdempotencyStore keeps keys in the idempotencyKeys table, so a
+// retry is recognized by any replica.
+type PostgresIdempotencyStore struct {
+	db *sql.DB
+}
+
+func NewPostgresIdempotencyStore(db *sql.DB) *PostgresIdempotencyStore {
+	return &PostgresIdempotencyStore{db: db}
+}
+
+func (s *PostgresIdempotencyStore) Begin(ctx context.Context, key string, fingerprint string) (*StoredResponse, error) {
+	// Expired keys are taken over, the WHERE makes the upsert a no-op for
+	// live ones.
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO idempotencyKeys(key, fingerprint, expiresAt) VALUES($1, $2, now() + make_interval(secs => $3))
+		ON CONFLICT (key) DO UPDATE SET
+			fingerprint = EXCLUDED.fingerprint,
+			status = NULL,
+			contentType = NULL,
+			body = NULL,
+			expiresAt = EXCLUDED.expiresAt
+		WHERE idempotencyKeys.expiresAt <= now()
+	`, key, fingerprint, idempotencyLockTimeout.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 1 {
+		return nil, nil
+	}
+
+	var storedFingerprint string
+	var status sql.NullInt64
+	var contentType sql.NullString
+	var body []byte
+	err = s.db.QueryRowContext(ctx, "SELECT fingerprint, status, contentType, body FROM idempotencyKeys WHERE key=$1", key).
+		Scan(&storedFingerprint, &status, &contentType, &body)
+	if err != nil {
+		return nil, err
+	}
+	if storedFingerprint != fingerprint {
+		return nil, ErrIdempotencyMismatch
+	}
+	if !status.Valid {
+		return nil, ErrIdempotencyInProgress
+	}
+	return &StoredResponse{
+		Status:      int(status.Int64),
+		ContentType: contentType.String,
+		Body:        body,
+	}, nil
+}
+
+func (s *PostgresIdempotencyStore) Complete(ctx context.Context, key string, resp StoredResponse, ttl time.Duration) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE idempotencyKeys SET status=$1, contentType=$2, body=$3, expiresAt=now() + make_interval(secs => $4)
+		WHERE key=$5
+	`, resp.Status, resp.ContentType, resp.Body, ttl.Seconds(), key)
+	return err
+}
+
+func (s *PostgresIdempotencyStore) Release(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM idempotencyKeys WHERE key=$1 AND status IS NULL", key)
+	return err
+}
+
+func (s *PostgresIdempotencyStore) Purge(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM idempotencyKeys WHERE expiresAt <= now()")
+	return err
+}
+
+var idempotencyStore IdempotencyStore
+var idempotencyTTL time.Duration
+
+func PurgeIdempotencyKeys(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := idempotencyStore.Purge(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to purge idempotency keys", "error", err)
+		}
+	}
+}
+
+// responseRecorder passes the response through and keeps a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// requestFingerprint tells apart different requests sent with the same key.
+func requestFingerprint(req *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", req.Method, req.URL.RequestURI())
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Idempotency replays the stored response when a request is retried with the
+// same Idempotency-Key. Keys are scoped per user, so it has to run after
+// RequireAuth. Requests without the header are not affected.
+func Idempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		idempotencyKey := req.Header.Get(IdempotencyKeyHeader)
+		if idempotencyKey == "" || req.Method == http.MethodGet || req.Method == http.MethodHead {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if len(idempotencyKey) > maxIdempotencyKeyLength {
+			http.Error(w, fmt.Sprintf("%s must not be longer than %d characters", IdempotencyKeyHeader, maxIdempotencyKeyLength),
+				http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBodySize))
+		req.Body.Close()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Request body must not be larger than %d bytes", maxBodySize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		key := fmt.Sprintf("%d:%s", CurrentPrincipal(req).Id, idempotencyKey)
+		stored, err := idempotencyStore.Begin(req.Context(), key, requestFingerprint(req, body))
+		if errors.Is(err, ErrIdempotencyInProgress) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, ErrIdempotencyMismatch) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to check idempotency key: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		if stored != nil {
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			// The handler failed or panicked, the request may be retried.
+			err := idempotencyStore.Release(context.Background(), key)
+			if err != nil {
+				slog.ErrorContext(req.Context(), "Failed to release idempotency key", "error", err)
+			}
+		}()
+
+		next.ServeHTTP(recorder, req)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		// Server errors are not final, retrying them should run the request
+		// again.
+		if status >= http.StatusInternalServerError {
+			return
+		}
+		completed = true
+
+		err = idempotencyStore.Complete(context.Background(), key, StoredResponse{
+			Status:      status,
+			ContentType: recorder.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+		}, idempotencyTTL)
+		if err != nil {
+			slog.ErrorContext(req.Context(), "Failed to store response for idempotency key", "error", err)
+		}
+	})
+}
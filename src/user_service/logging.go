@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"common/logging"
+	"common/metrics"
+)
+
+// accessLogFields collects access log fields that only handlers further down
+// the chain know about.
+type accessLogFields struct {
+	user string
+}
+
+type accessLogFieldsKey struct{}
+
+// SetLogUser names the user in the access log of the request.
+func SetLogUser(ctx context.Context, username string) {
+	fields, ok := ctx.Value(accessLogFieldsKey{}).(*accessLogFields)
+	if ok {
+		fields.user = username
+	}
+}
+
+// RequestLogging assigns every request an ID, returns it in X-Request-ID and
+// writes one access log line once the request is served.
+func RequestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestId := req.Header.Get(logging.RequestIDHeader)
+		if !logging.ValidRequestID(requestId) {
+			requestId, _ = NewRandomId()
+		}
+		w.Header().Set(logging.RequestIDHeader, requestId)
+
+		fields := &accessLogFields{}
+		ctx := context.WithValue(logging.WithRequestID(req.Context(), requestId), accessLogFieldsKey{}, fields)
+		req = req.WithContext(ctx)
+
+		recorder := metrics.NewStatusRecorder(w)
+		start := time.Now()
+		next.ServeHTTP(recorder, req)
+
+		attrs := []any{
+			slog.String("method", req.Method),
+			slog.String("route", metrics.RouteTemplate(req)),
+			slog.String("path", req.URL.Path),
+			slog.Int("status", recorder.Status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client", ClientIP(req)),
+		}
+		if fields.user != "" {
+			attrs = append(attrs, slog.String("user", fields.user))
+		}
+		// {id} is the post id in every route that has it.
+		postId := mux.Vars(req)["id"]
+		if postId != "" {
+			attrs = append(attrs, slog.String("post_id", postId))
+		}
+
+		level := slog.LevelInfo
+		if recorder.Status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.Log(ctx, level, "Request served", attrs...)
+	})
+}
+
+// GRPCRequestID passes the request ID on to post_service.
+func GRPCRequestID(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	requestId := logging.RequestIDFromContext(ctx)
+	if requestId != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, logging.RequestIDMetadata, requestId)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers mail to users. Only local implementations exist so far,
+// a real one only has to implement Send.
+type Mailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+var mailer Mailer = LogMailer{}
+
+// LogMailer writes mail to the service log.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, mail Mail) error {
+	slog.InfoContext(ctx, "Mail sent", "to", mail.To, "subject", mail.Subject, "body", mail.Body)
+	return nil
+}
+
+// FileMailer stores every mail as a separate file in a directory.
+type FileMailer struct {
+	Dir string
+}
+
+func (m FileMailer) Send(ctx context.Context, mail Mail) error {
+	err := os.MkdirAll(m.Dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	id, err := NewRandomId()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), id)
+	content := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s\r\n", mail.To, mail.Subject, mail.Body)
+	return os.WriteFile(filepath.Join(m.Dir, name), []byte(content), 0600)
+}
@@ -1,22 +1,40 @@
 package main
 
 import (
+	"context"
 	"crypto/rsa"
 	"database/sql"
 	"flag"
 	"fmt"
+	"log/slog"
  	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/XSAM/otelsql"
 	_ "github.com/lib/pq"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 
+	"common/config"
+	"common/database"
+	"common/health"
+	"common/logging"
+	"common/metrics"
+	"common/tracing"
 	pb "user_service/proto"
 )
 
@@ -30,79 +48,65 @@ var privateKey *rsa.PrivateKey
 var kafkaLikeWriter *kafka.Writer
 var kafkaViewWriter *kafka.Writer
 
-func ConnectToPostService(addr string) error {
-	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+var postServiceConn *grpc.ClientConn
+
+func ConnectToPostService(addrs string, creds credentials.TransportCredentials, timeout time.Duration) error {
+	target, opts := postServiceTarget(addrs)
+	opts = append(opts,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultServiceConfig(postServiceConfig),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+		grpc.WithChainUnaryInterceptor(GRPCRequestID, GRPCClientMetrics, postServiceBreaker.Interceptor, GRPCDeadline(timeout)),
+	)
+	conn, err := grpc.Dial(target, opts...)
 	if err != nil {
 		return err
 	}
+	postServiceConn = conn
 	postServiceClient = pb.NewPostServiceClient(conn)
 	return nil
 }
 
-func main() {
-	privateFile := flag.String("private", "", "path to JWT private key `file`")
-	publicFile := flag.String("public", "", "path to JWT public key `file`")
-	port := flag.Int("port", 8080, "http server port")
-	dbHost := flag.String("db-host", "", "hostname of the database")
-	dbPort := flag.Int("db-port", 5432, "port of the database")
-	dbName := flag.String("db-name", "", "database name")
-	dbUsername := flag.String("db-username", "", "database user")
-	dbPassword := flag.String("db-password", "", "database password")
-	postServerAddr := flag.String("post-server-addr", "", "address of the gRPC post server")
-	kafkaURL := flag.String("kafka-url", "", "address of the Kafka")
-
-	flag.Parse()
-
-	if port == nil {
-		fmt.Fprintln(os.Stderr, "Port is required")
-		os.Exit(1)
-	}
-	if privateFile == nil || *privateFile == "" {
-		fmt.Fprintln(os.Stderr, "Please provide a path to JWT private key file")
-		os.Exit(1)
-	}
-	if publicFile == nil || *publicFile == "" {
-		fmt.Fprintln(os.Stderr, "Please provide a path to JWT public key file")
-		os.Exit(1)
-	}
-	if dbHost == nil || *dbHost == "" {
-		fmt.Fprintln(os.Stderr, "Please provide a hostname of the database")
-		os.Exit(1)
-	}
-	if dbPort == nil {
-		fmt.Fprintln(os.Stderr, "Please provide a port of the database")
-		os.Exit(1)
-	}
-	if dbName == nil || *dbName == ""  {
-		fmt.Fprintln(os.Stderr, "Please provide a database name")
-		os.Exit(1)
-	}
-	if dbUsername == nil || *dbUsername == ""  {
-		fmt.Fprintln(os.Stderr, "Please provide a database username")
-		os.Exit(1)
-	}
-	if dbPassword == nil || *dbPassword == ""  {
-		fmt.Fprintln(os.Stderr, "Please provide a database password")
-		os.Exit(1)
+// waitContext waits for wg and reports false if ctx is done first.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
 	}
+}
 
-	if postServerAddr == nil || *postServerAddr == ""  {
-		fmt.Fprintln(os.Stderr, "Please provide a database post server address")
+func main() {
+	var cfg Config
+	cfg.RegisterFlags(flag.CommandLine)
+	err := config.Load(flag.CommandLine, envPrefix, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
 		os.Exit(1)
 	}
-
-	if kafkaURL == nil || *kafkaURL == ""  {
-		fmt.Fprintln(os.Stderr, "Please provide Kafka address")
+	err = cfg.Validate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
 		os.Exit(1)
 	}
 
-	absolutePrivateFile, err := filepath.Abs(*privateFile)
+	logging.Init("user_service", cfg.LogLevel)
+	config.Log(flag.CommandLine, secretSettings)
+
+	absolutePrivateFile, err := filepath.Abs(cfg.PrivateKeyFile)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	absolutePublicFile, err := filepath.Abs(*publicFile)
+	absolutePublicFile, err := filepath.Abs(cfg.PublicKeyFile)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -133,36 +137,64 @@ func main() {
 	}
 
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s sslmode=disable",
-		*dbHost, *dbPort, *dbUsername, *dbPassword)
-    db, err = sql.Open("postgres", psqlInfo)
+		cfg.DBHost, cfg.DBPort, cfg.DBUsername, cfg.DBPassword)
+	shutdownTracing, err := tracing.Init(context.Background(), "user_service", cfg.TracingExporter, cfg.OTLPEndpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to set up tracing:", err)
+		os.Exit(1)
+	}
+
+	db, err = otelsql.Open("postgres", psqlInfo,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{SpanFilter: tracing.TracedQueriesOnly}),
+	)
 	if err != nil {
         panic(err)
     } 
-    defer db.Close()
 
-	for i := 0; i < 5; i++ {
-		err = db.Ping()
-		if err == nil {
-			break
-		}
-		time.Sleep(time.Second)
-	}
-	err = db.Ping()
+	database.PoolConfig{
+		MaxOpenConns:    cfg.DBMaxOpenConns,
+		MaxIdleConns:    cfg.DBMaxIdleConns,
+		ConnMaxLifetime: cfg.DBConnMaxLifetime,
+		ConnMaxIdleTime: cfg.DBConnMaxIdleTime,
+	}.Apply(db)
+	database.Policy.MaxAttempts = cfg.DBRetryAttempts
+
+	err = database.Wait(context.Background(), db, cfg.DBConnectTimeout)
 	if err != nil {
 		panic(err)
 	}
 
-	_, err = db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", *dbName))
+	// "user_service promote-admins" makes the configured admins of a running
+	// deployment admins and exits, before anything is set up.
+	if flag.Arg(0) == "promote-admins" {
+		var admins []string
+		for _, admin := range strings.Split(cfg.Admins, ",") {
+			admin = strings.TrimSpace(admin)
+			if admin != "" {
+				admins = append(admins, admin)
+			}
+		}
+		promoted, err := PromoteAdmins(context.Background(), admins)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to promote admins:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Promoted %d accounts to admin\n", promoted)
+		return
+	}
+
+	_, err = db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", cfg.DBName))
 	if err != nil {
 		panic(err)
 	}
 
-	_, err = db.Exec(fmt.Sprintf("CREATE DATABASE %s", *dbName))
+	_, err = db.Exec(fmt.Sprintf("CREATE DATABASE %s", cfg.DBName))
 	if err != nil {
 		panic(err)
 	}
 
-	_, err = db.Exec("DROP TABLE IF EXISTS users")
+	_, err = db.Exec("DROP TABLE IF EXISTS follows, idempotencyKeys, rateLimits, loginAttempts, recoveryCodes, passwordResets, exportJobs, accountDeletions, sessions, users")
 	if err != nil {
 		panic(err)
 	}
@@ -176,47 +208,405 @@ func main() {
 			lastName    TEXT,
 			dateOfBirth TEXT,
 			mail       	TEXT,
-			phone       TEXT
+			phone       TEXT,
+			mailVerified BOOLEAN NOT NULL DEFAULT FALSE,
+			totpSecret  TEXT,
+			totpEnabled BOOLEAN NOT NULL DEFAULT FALSE,
+			totpLastStep BIGINT NOT NULL DEFAULT 0,
+			role        TEXT NOT NULL DEFAULT 'user',
+			banned      BOOLEAN NOT NULL DEFAULT FALSE,
+			createdAt   TIMESTAMPTZ NOT NULL DEFAULT now(),
+			deletedAt   TIMESTAMPTZ
 		)
 	`)
 	if err != nil {
 		panic(err)
 	}
 
-	err = ConnectToPostService(*postServerAddr)
+	// Usernames stay taken after the account is deleted, other services still
+	// clean up data by username.
+	_, err = db.Exec("CREATE UNIQUE INDEX usersLowerUsername ON users (lower(username))")
 	if err != nil {
 		panic(err)
 	}
 
-	kafkaLikeWriter = &kafka.Writer{
-		Addr:     kafka.TCP(*kafkaURL),
-		Topic:    "likes",
+	_, err = db.Exec(`
+		CREATE TABLE sessions (
+			id 			TEXT PRIMARY KEY,
+			userId 		INTEGER NOT NULL REFERENCES users(id),
+			createdAt 	TIMESTAMPTZ NOT NULL DEFAULT now(),
+			revokedAt 	TIMESTAMPTZ
+		)
+	`)
+	if err != nil {
+		panic(err)
 	}
-	defer kafkaLikeWriter.Close()
 
-	kafkaViewWriter = &kafka.Writer{
-		Addr:     kafka.TCP(*kafkaURL),
-		Topic:    "views",
+	_, err = db.Exec(`
+		CREATE TABLE accountDeletions (
+			userId 				INTEGER PRIMARY KEY REFERENCES users(id),
+			username 			TEXT NOT NULL UNIQUE,
+			requestedAt 		TIMESTAMPTZ NOT NULL DEFAULT now(),
+			lastAttemptAt 		TIMESTAMPTZ NOT NULL DEFAULT now(),
+			postsDoneAt 		TIMESTAMPTZ,
+			statisticsDoneAt 	TIMESTAMPTZ,
+			completedAt 		TIMESTAMPTZ
+		)
+	`)
+	if err != nil {
+		panic(err)
 	}
-	defer kafkaViewWriter.Close()
 
-	r := mux.NewRouter()
+	_, err = db.Exec(`
+		CREATE TABLE exportJobs (
+			id 			TEXT PRIMARY KEY,
+			userId 		INTEGER NOT NULL REFERENCES users(id),
+			status 		TEXT NOT NULL,
+			progress 	INTEGER NOT NULL DEFAULT 0,
+			error 		TEXT,
+			path 		TEXT,
+			createdAt 	TIMESTAMPTZ NOT NULL DEFAULT now(),
+			finishedAt 	TIMESTAMPTZ
+		)
+	`)
+	if err != nil {
+		panic(err)
+	}
+	// One export per user at a time.
+	_, err = db.Exec("CREATE UNIQUE INDEX exportJobsActive ON exportJobs (userId) WHERE status IN ('pending', 'running')")
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE passwordResets (
+			tokenHash 	TEXT PRIMARY KEY,
+			userId 		INTEGER NOT NULL REFERENCES users(id),
+			createdAt 	TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expiresAt 	TIMESTAMPTZ NOT NULL,
+			usedAt 		TIMESTAMPTZ
+		)
+	`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE recoveryCodes (
+			userId 		INTEGER NOT NULL REFERENCES users(id),
+			codeHash 	TEXT NOT NULL,
+			usedAt 		TIMESTAMPTZ,
+			PRIMARY KEY (userId, codeHash)
+		)
+	`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE loginAttempts (
+			key 			TEXT PRIMARY KEY,
+			failures 		INTEGER NOT NULL,
+			lastFailureAt 	TIMESTAMPTZ NOT NULL
+		)
+	`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE rateLimits (
+			key 		TEXT PRIMARY KEY,
+			tokens 		DOUBLE PRECISION NOT NULL,
+			updatedAt 	TIMESTAMPTZ NOT NULL
+		)
+	`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE follows (
+			followerId 	INTEGER NOT NULL REFERENCES users(id),
+			followeeId 	INTEGER NOT NULL REFERENCES users(id),
+			createdAt 	TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (followerId, followeeId)
+		)
+	`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE idempotencyKeys (
+			key 			TEXT PRIMARY KEY,
+			fingerprint 	TEXT NOT NULL,
+			status 			INTEGER,
+			contentType 	TEXT,
+			body 			BYTEA,
+			expiresAt 		TIMESTAMPTZ NOT NULL
+		)
+	`)
+	if err != nil {
+		panic(err)
+	}
+
+	if cfg.MailDir != "" {
+		mailer = FileMailer{Dir: cfg.MailDir}
+	}
+	passwordResetTTL = cfg.PasswordResetTTL
+	emailVerificationTTL = cfg.EmailVerificationTTL
+	mfaTokenTTL = cfg.MFATokenTTL
+	requireVerifiedEmail = cfg.RequireVerifiedEmail
+
+	userPolicy := ThrottlePolicy{
+		FreeAttempts: cfg.LoginFreeAttempts,
+		BaseDelay:    cfg.LoginBaseDelay,
+		MaxDelay:     cfg.LoginMaxDelay,
+		Window:       cfg.LoginWindow,
+	}
+	ipPolicy := userPolicy
+	ipPolicy.FreeAttempts = cfg.LoginIPFreeAttempts
+	if cfg.LoginThrottleStore == "postgres" {
+		userLoginThrottle = NewPostgresLoginThrottle(userPolicy, db)
+		ipLoginThrottle = NewPostgresLoginThrottle(ipPolicy, db)
+	} else {
+		userLoginThrottle = NewMemoryLoginThrottle(userPolicy)
+		ipLoginThrottle = NewMemoryLoginThrottle(ipPolicy)
+	}
 
-	r.HandleFunc("/user/register", RegisterUser).Methods("POST")
-	r.HandleFunc("/user/login", LoginUser).Methods("POST")
-	r.HandleFunc("/user/update", UpdateUser).Methods("PUT")
+	maxBodySize = cfg.MaxBodySize
+	maxFollowing = cfg.MaxFollowing
+	// Already checked by Validate.
+	rateLimitQuotas, _ = ParseQuotas(cfg.RateLimits)
+	if cfg.RateLimitStore == "postgres" {
+		rateLimitStore = NewPostgresRateLimitStore(db)
+	} else {
+		rateLimitStore = NewMemoryRateLimitStore()
+	}
 
-	r.HandleFunc("/post", CreatePost).Methods("POST")
-	r.HandleFunc("/post/{id}", UpdatePost).Methods("PUT")
-	r.HandleFunc("/post/{id}", DeletePost).Methods("DELETE")
-	r.HandleFunc("/post/{id}", GetPost).Methods("GET")
-	r.HandleFunc("/posts", ListPosts).Methods("GET")
+	idempotencyTTL = cfg.IdempotencyTTL
+	if cfg.IdempotencyStore == "postgres" {
+		idempotencyStore = NewPostgresIdempotencyStore(db)
+	} else {
+		idempotencyStore = NewMemoryIdempotencyStore()
+	}
 
-	r.HandleFunc("/post/{id}/like", Like).Methods("POST")
-	r.HandleFunc("/post/{id}/view", View).Methods("POST")
+	exportDir = cfg.ExportDir
+	exportLinkTTL = cfg.ExportLinkTTL
+	exportTimeout = cfg.ExportTimeout
+	exportSlots = make(chan struct{}, cfg.ExportConcurrency)
+	err = FailInterruptedExports(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	publicURL = strings.TrimSuffix(cfg.PublicURL, "/")
+	statisticsServiceURL = strings.TrimSuffix(cfg.StatisticsServerURL, "/")
+	statisticsClient = &http.Client{Timeout: cfg.StatisticsServerTimeout}
+
+	var postServerCreds credentials.TransportCredentials = insecure.NewCredentials()
+	if cfg.PostServerCA != "" || cfg.PostServerCert != "" {
+		postServerCreds, err = NewPostServiceCredentials(cfg.PostServerCA, cfg.PostServerCert, cfg.PostServerKey, cfg.PostServerName)
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	err = http.ListenAndServe(fmt.Sprintf(":%d", *port), r)
+	postServiceBreaker.Failures = cfg.PostServerBreakerFailures
+	postServiceBreaker.Cooldown = cfg.PostServerBreakerCooldown
+	err = ConnectToPostService(cfg.PostServerAddr, postServerCreds, cfg.PostServerTimeout)
 	if err != nil {
 		panic(err)
 	}
+
+	kafkaWriterConfig := KafkaWriterConfig{
+		RequiredAcks: cfg.KafkaRequiredAcks,
+		BatchSize:    cfg.KafkaBatchSize,
+		BatchTimeout: cfg.KafkaBatchTimeout,
+		Compression:  cfg.KafkaCompression,
+	}
+	kafkaLikeWriter = NewKafkaWriter(cfg.KafkaURL, "likes", kafkaWriterConfig)
+	kafkaViewWriter = NewKafkaWriter(cfg.KafkaURL, "views", kafkaWriterConfig)
+	kafkaUserEventWriter = NewKafkaWriter(cfg.KafkaURL, "users", kafkaWriterConfig)
+
+	var spools []*Spool
+	if cfg.KafkaAsync {
+		for _, writer := range []*kafka.Writer{kafkaLikeWriter, kafkaViewWriter} {
+			spool, err := NewSpool(cfg.KafkaSpoolDir, writer, cfg.KafkaSpoolMaxBytes)
+			if err != nil {
+				panic(err)
+			}
+			spools = append(spools, spool)
+		}
+		likePublisher, viewPublisher = spools[0], spools[1]
+	} else {
+		likePublisher = SyncPublisher{Writer: kafkaLikeWriter}
+		viewPublisher = SyncPublisher{Writer: kafkaViewWriter}
+	}
+
+	// Background workers stop when ctx is cancelled by SIGINT or SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var workers sync.WaitGroup
+	startWorker := func(run func(ctx context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run(ctx)
+		}()
+	}
+	startWorker(func(ctx context.Context) {
+		ConsumeDeletionProgress(ctx, cfg.KafkaURL)
+	})
+	startWorker(func(ctx context.Context) {
+		RetryAccountDeletions(ctx, cfg.DeletionRetryInterval)
+	})
+	startWorker(func(ctx context.Context) {
+		PurgeIdempotencyKeys(ctx, time.Minute)
+	})
+	startWorker(func(ctx context.Context) {
+		PurgeExports(ctx, cfg.ExportRetention, time.Minute)
+	})
+	for _, spool := range spools {
+		startWorker(func(ctx context.Context) {
+			spool.Run(ctx, cfg.KafkaSpoolInterval)
+		})
+	}
+
+	userCache = NewTTLCache[*Principal](cfg.UserCacheTTL)
+	sessionCache = NewTTLCache[uint64](cfg.UserCacheTTL)
+	followingCache = NewTTLCache[[]string](cfg.UserCacheTTL)
+
+	RegisterDBMetrics("users")
+
+	readinessChecks := []health.Check{
+		{Name: "postgres", Check: CheckPostgres},
+		{Name: "kafka", Check: health.KafkaCheck(cfg.KafkaURL)},
+		{Name: "post_service", Check: CheckPostService},
+	}
+
+	r := mux.NewRouter()
+
+	r.HandleFunc("/healthz", health.Healthz).Methods("GET")
+	r.Handle("/readyz", health.Readyz(readinessChecks)).Methods("GET")
+
+	r.Use(otelmux.Middleware("user_service"), RequestLogging, metrics.HTTP, RateLimit)
+
+	publicRoutes := r.NewRoute().Subrouter()
+	publicRoutes.HandleFunc("/user/register", RegisterUser).Methods("POST").Name("register")
+	publicRoutes.HandleFunc("/user/login", LoginUser).Methods("POST").Name("login")
+	publicRoutes.HandleFunc("/user/login/2fa", LoginSecondFactor).Methods("POST").Name("loginSecondFactor")
+	publicRoutes.HandleFunc("/user/verify", VerifyEmail).Methods("GET").Name("verifyEmail")
+	publicRoutes.HandleFunc("/user/password/forgot", ForgotPassword).Methods("POST").Name("forgotPassword")
+	publicRoutes.HandleFunc("/user/password/reset", ResetPassword).Methods("POST").Name("resetPassword")
+	publicRoutes.HandleFunc("/user/export/download", DownloadExport).Methods("GET").Name("downloadExport")
+
+	protectedRoutes := r.NewRoute().Subrouter()
+	protectedRoutes.Use(RequireAuth, Idempotency)
+	protectedRoutes.HandleFunc("/user/update", UpdateUser).Methods("PUT").Name("updateUser")
+	protectedRoutes.HandleFunc("/user/verify/resend", ResendVerification).Methods("POST").Name("resendVerification")
+	protectedRoutes.HandleFunc("/user/password", ChangePassword).Methods("PUT").Name("changePassword")
+	protectedRoutes.HandleFunc("/user/2fa", DisableTOTP).Methods("DELETE").Name("disableTOTP")
+	protectedRoutes.HandleFunc("/user/me", DeleteAccount).Methods("DELETE").Name("deleteAccount")
+	protectedRoutes.HandleFunc("/user/me/export", StartExport).Methods("POST").Name("startExport")
+	protectedRoutes.HandleFunc("/user/me/export/{jobId}", GetExport).Methods("GET").Name("getExport")
+	protectedRoutes.HandleFunc("/user/me/following", ListFollowing).Methods("GET").Name("listFollowing")
+	protectedRoutes.HandleFunc("/user/{username}/follow", FollowUser).Methods("PUT").Name("followUser")
+	protectedRoutes.HandleFunc("/user/{username}/follow", UnfollowUser).Methods("DELETE").Name("unfollowUser")
+	protectedRoutes.Handle("/post", RequireVerifiedEmail(http.HandlerFunc(CreatePost))).Methods("POST").Name("createPost")
+	protectedRoutes.HandleFunc("/post/{id}", UpdatePost).Methods("PUT").Name("updatePost")
+	protectedRoutes.HandleFunc("/post/{id}", DeletePost).Methods("DELETE").Name("deletePost")
+	protectedRoutes.HandleFunc("/post/{id}/restore", RestorePost).Methods("POST").Name("restorePost")
+	protectedRoutes.HandleFunc("/post/{id}/like", Like).Methods("POST").Name("like")
+	protectedRoutes.HandleFunc("/post/{id}/view", View).Methods("POST").Name("view")
+
+	// Responses carrying secrets are not kept for idempotent replays, they
+	// would stay in the idempotency store long after the user saw them.
+	secretRoutes := r.NewRoute().Subrouter()
+	secretRoutes.Use(RequireAuth)
+	secretRoutes.HandleFunc("/user/2fa/enroll", EnrollTOTP).Methods("POST").Name("enrollTOTP")
+	secretRoutes.HandleFunc("/user/2fa/confirm", ConfirmTOTP).Methods("POST").Name("confirmTOTP")
+
+	adminRoutes := r.NewRoute().Subrouter()
+	adminRoutes.Use(RequireAuth, Idempotency)
+	adminRoutes.Handle("/admin/users", RequirePermission(PermissionListUsers)(http.HandlerFunc(ListUsers))).Methods("GET").Name("listUsers")
+	adminRoutes.Handle("/admin/users/{username}/ban", RequirePermission(PermissionBanUsers)(http.HandlerFunc(BanUser))).Methods("PUT").Name("banUser")
+	adminRoutes.Handle("/admin/users/{username}/ban", RequirePermission(PermissionBanUsers)(http.HandlerFunc(UnbanUser))).Methods("DELETE").Name("unbanUser")
+	adminRoutes.Handle("/admin/users/{username}/role", RequirePermission(PermissionManageRoles)(http.HandlerFunc(SetUserRole))).Methods("PUT").Name("setUserRole")
+	adminRoutes.Handle("/admin/posts/{id}", RequirePermission(PermissionModeratePosts)(http.HandlerFunc(DeletePost))).Methods("DELETE").Name("moderatePost")
+
+	optionalAuthRoutes := r.NewRoute().Subrouter()
+	optionalAuthRoutes.Use(OptionalAuth)
+	optionalAuthRoutes.HandleFunc("/post/{id}", GetPost).Methods("GET").Name("getPost")
+	optionalAuthRoutes.HandleFunc("/posts", ListPosts).Methods("GET").Name("listPosts")
+	optionalAuthRoutes.HandleFunc("/post/{id}/revisions", ListPostRevisions).Methods("GET").Name("listPostRevisions")
+	optionalAuthRoutes.HandleFunc("/post/{id}/revisions/{revision}", GetPostRevision).Methods("GET").Name("getPostRevision")
+
+	// Metrics name routes and expose error rates and pool stats, they are
+	// served on a port that is never published.
+	internal := http.NewServeMux()
+	internal.Handle("GET /metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.Port),
+		Handler: r,
+	}
+	internalServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.InternalPort),
+		Handler: internal,
+	}
+	for _, srv := range []*http.Server{server, internalServer} {
+		go func() {
+			err := srv.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				panic(err)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting requests and let the running ones finish, then wait for
+	// background work, and only then close what they write to.
+	for _, srv := range []*http.Server{server, internalServer} {
+		err = srv.Shutdown(shutdownCtx)
+		if err != nil {
+			slog.Error("Failed to drain HTTP server", "addr", srv.Addr, "error", err)
+		}
+	}
+	if !waitContext(shutdownCtx, &workers) {
+		slog.Warn("Background workers did not stop in time")
+	}
+	if !waitContext(shutdownCtx, &exportJobs) {
+		slog.Warn("Running exports did not finish in time")
+	}
+
+	// Closing the writers flushes messages that are still buffered.
+	for _, writer := range []*kafka.Writer{kafkaLikeWriter, kafkaViewWriter, kafkaUserEventWriter} {
+		err = writer.Close()
+		if err != nil {
+			slog.Error("Failed to flush Kafka writer", "topic", writer.Topic, "error", err)
+		}
+	}
+
+	err = postServiceConn.Close()
+	if err != nil {
+		slog.Error("Failed to close post service connection", "error", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		slog.Error("Failed to close database", "error", err)
+	}
+
+	err = shutdownTracing(shutdownCtx)
+	if err != nil {
+		slog.Error("Failed to flush spans", "error", err)
+	}
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// HTTP and Kafka metrics are shared by all services, see common/metrics.
+var (
+	grpcClientCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_client_handled_total",
+		Help: "gRPC calls made to post_service by method and status code.",
+	}, []string{"method", "code"})
+	grpcClientDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_client_handling_seconds",
+		Help:    "Time until post_service answered, by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+	grpcClientCircuitState = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "grpc_client_circuit_state",
+		Help: "State of the post_service circuit breaker: 0 closed, 1 open, 2 half-open.",
+	})
+
+	kafkaSpoolBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kafka_spool_bytes",
+		Help: "Size of the events spooled on disk and not yet written to Kafka, by topic.",
+	}, []string{"topic"})
+)
+
+// RegisterDBMetrics exports the connection pool statistics of db.
+func RegisterDBMetrics(name string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+func GRPCClientMetrics(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	grpcClientDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	grpcClientCalls.WithLabelValues(method, status.Code(err).String()).Inc()
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"common/database"
+)
+
+type Principal struct {
+	Id       uint64
+	Username string
+	Role     Role
+	Banned   bool
+
+	MailVerified bool
+
+	// SessionId is the session of the current request. It is not cached
+	// together with the rest of the user.
+	SessionId string
+}
+
+func (p *Principal) WithSession(sessionId string) *Principal {
+	principal := *p
+	principal.SessionId = sessionId
+	return &principal
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// CurrentPrincipal returns the authenticated user of the request, or nil for
+// anonymous requests on routes with optional authentication.
+func CurrentPrincipal(req *http.Request) *Principal {
+	principal, _ := req.Context().Value(principalKey{}).(*Principal)
+	return principal
+}
+
+var userCache = NewTTLCache[*Principal](0)
+
+func LoadPrincipal(ctx context.Context, username string) (*Principal, error) {
+	principal, ok := userCache.Get(username)
+	if ok {
+		return principal, nil
+	}
+
+	principal = &Principal{}
+	err := database.Retry(ctx, func() error {
+		return db.QueryRowContext(ctx, "SELECT id, username, role, banned, mailVerified FROM users WHERE username=$1 AND deletedAt IS NULL", username).
+			Scan(&principal.Id, &principal.Username, &principal.Role, &principal.Banned, &principal.MailVerified)
+	})
+	if err != nil {
+		return nil, errors.New("User not found")
+	}
+
+	userCache.Put(principal.Username, principal)
+	return principal, nil
+}
+
+func authenticateRequest(w http.ResponseWriter, req *http.Request, next http.Handler) {
+	token, err := Authenticate(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	principal, err := LoadPrincipal(req.Context(), token.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if principal.Banned {
+		http.Error(w, "User is banned", http.StatusForbidden)
+		return
+	}
+
+	err = CheckSession(req.Context(), token.SessionId, principal.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	principal = principal.WithSession(token.SessionId)
+	SetLogUser(req.Context(), principal.Username)
+
+	next.ServeHTTP(w, req.WithContext(WithPrincipal(req.Context(), principal)))
+}
+
+// RequireAuth rejects requests without a valid token.
+func RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authenticateRequest(w, req, next)
+	})
+}
+
+// OptionalAuth lets anonymous requests through, but still rejects requests
+// that carry an invalid token.
+func OptionalAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		authenticateRequest(w, req, next)
+	})
+}
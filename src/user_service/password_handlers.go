@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"common/database"
+)
+
+type PasswordChange struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type PasswordForgotten struct {
+	Username string `json:"username"`
+}
+
+type PasswordReset struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+var passwordResetTTL time.Duration
+
+func ChangePassword(w http.ResponseWriter, req *http.Request) {
+	principal := CurrentPrincipal(req)
+
+	change := PasswordChange{}
+	if !DecodeJSON(w, req, &change) {
+		return
+	}
+	validation := &ValidationErrors{}
+	ValidatePassword(validation, "newPassword", principal.Username, change.NewPassword)
+	if !validation.Empty() {
+		WriteValidationErrors(w, http.StatusBadRequest, validation)
+		return
+	}
+
+	var passwordHash string
+	err := db.QueryRow("SELECT password FROM users WHERE id=$1", principal.Id).Scan(&passwordHash)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if passwordHash != HashPassword(principal.Username, change.CurrentPassword) {
+		http.Error(w, "Incorrect password", http.StatusForbidden)
+		return
+	}
+
+	_, err = db.Exec("UPDATE users SET password=$1 WHERE id=$2",
+		HashPassword(principal.Username, change.NewPassword), principal.Id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to update password: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	err = RevokeSessions(principal.Id, principal.SessionId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// ForgotPassword always answers with 200, so it cannot be used to find out
+// which usernames exist.
+func ForgotPassword(w http.ResponseWriter, req *http.Request) {
+	forgotten := PasswordForgotten{}
+	if !DecodeJSON(w, req, &forgotten) {
+		return
+	}
+
+	var userId uint64
+	var mail *string
+	err := db.QueryRow("SELECT id, mail FROM users WHERE lower(username)=lower($1) AND deletedAt IS NULL", forgotten.Username).
+		Scan(&userId, &mail)
+	if err != nil || mail == nil || *mail == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(b)
+
+	err = database.RunInTx(req.Context(), db, func(tx *sql.Tx) error {
+		// Only the latest token stays usable.
+		_, err := tx.ExecContext(req.Context(), "UPDATE passwordResets SET usedAt=now() WHERE userId=$1 AND usedAt IS NULL", userId)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(req.Context(), "INSERT INTO passwordResets(tokenHash, userId, expiresAt) VALUES($1, $2, $3)",
+			HashToken(token), userId, time.Now().Add(passwordResetTTL))
+		return err
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create reset token: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	err = mailer.Send(req.Context(), Mail{
+		To:      *mail,
+		Subject: "Password reset",
+		Body: fmt.Sprintf("Somebody asked to reset the password of %s.\n\nUse this token within %s to set a new password:\n\n%s\n\nIf it was not you, ignore this message.",
+			forgotten.Username, passwordResetTTL, token),
+	})
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Failed to send password reset mail", "user", forgotten.Username, "error", err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func consumeResetToken(ctx context.Context, token string, newPassword string) (uint64, error) {
+	var userId uint64
+	err := database.RunInTx(ctx, db, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `
+			UPDATE passwordResets SET usedAt=now()
+			WHERE tokenHash=$1 AND usedAt IS NULL AND expiresAt > now()
+			RETURNING userId
+		`, HashToken(token)).Scan(&userId)
+		if err == sql.ErrNoRows {
+			return errors.New("Invalid or expired token")
+		}
+		if err != nil {
+			return err
+		}
+
+		var username string
+		err = tx.QueryRowContext(ctx, "SELECT username FROM users WHERE id=$1 AND deletedAt IS NULL", userId).Scan(&username)
+		if err == sql.ErrNoRows {
+			return errors.New("Invalid or expired token")
+		}
+		if err != nil {
+			return err
+		}
+
+		validation := &ValidationErrors{}
+		ValidatePassword(validation, "newPassword", username, newPassword)
+		if !validation.Empty() {
+			return validation
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE users SET password=$1 WHERE id=$2", HashPassword(username, newPassword), userId)
+		return err
+	})
+	return userId, err
+}
+
+func ResetPassword(w http.ResponseWriter, req *http.Request) {
+	reset := PasswordReset{}
+	if !DecodeJSON(w, req, &reset) {
+		return
+	}
+	// The username is only known with a valid token, the rest of the policy
+	// is checked before the token is used up.
+	validation := &ValidationErrors{}
+	ValidatePassword(validation, "newPassword", "", reset.NewPassword)
+	if !validation.Empty() {
+		WriteValidationErrors(w, http.StatusBadRequest, validation)
+		return
+	}
+
+	userId, err := consumeResetToken(req.Context(), reset.Token, reset.NewPassword)
+	var commitErr *database.CommitError
+	if errors.As(err, &commitErr) {
+		// The password may have been changed, the token is not reported as
+		// invalid then.
+		http.Error(w, fmt.Sprintf("Failed to reset password: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err = RevokeSessions(userId, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -1,11 +1,8 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"strconv"
 
@@ -16,54 +13,27 @@ import (
 )
 
 type PostContent struct {
-	Content string `json:"content"`
-}
-
-func CheckUserExists(username string) error {
-	var userId uint64
-    err := db.QueryRow("SELECT id FROM users WHERE username=$1", username).Scan(&userId)
-    if err != nil {
-		return errors.New("User not found")
-    }
-	return nil
+	Content    string `json:"content"`
+	Visibility string `json:"visibility"`
 }
 
 func CreatePost(w http.ResponseWriter, req *http.Request) {
-	username, err := Authenticate(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-    }
-
-	err = CheckUserExists(username)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusNotFound)
-        return
-    }
-
-	body := make([]byte, req.ContentLength)
-	_, err = req.Body.Read(body)
-	defer req.Body.Close()
-	if err != io.EOF {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
+	username := CurrentPrincipal(req).Username
 
 	postContent := PostContent{}
-	err = json.Unmarshal(body, &postContent)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !DecodeJSON(w, req, &postContent) {
 		return
 	}
 
 	grpcReq := &pb.CreatePostRequest{
-		Username: username,
-		Content:  postContent.Content,
+		Username:   username,
+		Content:    postContent.Content,
+		Visibility: postContent.Visibility,
 	}
 	
-	resp, err := postServiceClient.CreatePost(context.Background(), grpcReq)
+	resp, err := postServiceClient.CreatePost(req.Context(), grpcReq)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create post: %s", err.Error()), http.StatusBadRequest)
+		WritePostServiceError(w, "create post", err)
 		return
 	}
 
@@ -72,30 +42,10 @@ func CreatePost(w http.ResponseWriter, req *http.Request) {
 }
 
 func UpdatePost(w http.ResponseWriter, req *http.Request) {
-	username, err := Authenticate(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-    }
-
-	err = CheckUserExists(username)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusNotFound)
-        return
-    }
-
-	body := make([]byte, req.ContentLength)
-	_, err = req.Body.Read(body)
-	defer req.Body.Close()
-	if err != io.EOF {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
+	username := CurrentPrincipal(req).Username
 
 	postContent := PostContent{}
-	err = json.Unmarshal(body, &postContent)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !DecodeJSON(w, req, &postContent) {
 		return
 	}
 
@@ -110,11 +60,12 @@ func UpdatePost(w http.ResponseWriter, req *http.Request) {
 		Id:		  postId,
 		Username: username,
 		Content:  postContent.Content,
+		Visibility: postContent.Visibility,
 	}
 	
-	_, err = postServiceClient.UpdatePost(context.Background(), grpcReq)
+	_, err = postServiceClient.UpdatePost(req.Context(), grpcReq)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to update post: %s", err.Error()), http.StatusBadRequest)
+		WritePostServiceError(w, "update post", err)
 		return
 	}
 
@@ -122,17 +73,7 @@ func UpdatePost(w http.ResponseWriter, req *http.Request) {
 }
 
 func DeletePost(w http.ResponseWriter, req *http.Request) {
-	username, err := Authenticate(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-    }
-
-	err = CheckUserExists(username)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusNotFound)
-        return
-    }
+	principal := CurrentPrincipal(req)
 
 	params := mux.Vars(req)
 	postId, err := strconv.ParseUint(params["id"], 10, 64)
@@ -143,31 +84,46 @@ func DeletePost(w http.ResponseWriter, req *http.Request) {
 
 	grpcReq := &pb.DeletePostRequest{
 		Id:		  postId,
-		Username: username,
+		Username: principal.Username,
+		Role:     string(principal.Role),
+		// Only moderators may delete permanently, post_service checks it.
+		Permanent: req.URL.Query().Get("permanent") == "true",
 	}
 	
-	_, err = postServiceClient.DeletePost(context.Background(), grpcReq)
+	_, err = postServiceClient.DeletePost(req.Context(), grpcReq)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to delete post: %s", err.Error()), http.StatusBadRequest)
+		WritePostServiceError(w, "delete post", err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func GetPost(w http.ResponseWriter, req *http.Request) {
-	username, err := Authenticate(req)
+func RestorePost(w http.ResponseWriter, req *http.Request) {
+	username := CurrentPrincipal(req).Username
+
+	params := mux.Vars(req)
+	postId, err := strconv.ParseUint(params["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	grpcReq := &pb.RestorePostRequest{
+		Id:       postId,
+		Username: username,
+	}
+
+	_, err = postServiceClient.RestorePost(req.Context(), grpcReq)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		WritePostServiceError(w, "restore post", err)
 		return
-    }
+	}
 
-	err = CheckUserExists(username)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusNotFound)
-        return
-    }
+	w.WriteHeader(http.StatusOK)
+}
 
+func GetPost(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
 	postId, err := strconv.ParseUint(params["id"], 10, 64)
 	if err != nil {
@@ -175,13 +131,20 @@ func GetPost(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	viewer, err := RequestViewer(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get post: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
 	grpcReq := &pb.GetPostRequest{
-		Id:		  postId,
+		Id:     postId,
+		Viewer: viewer,
 	}
 	
-	resp, err := postServiceClient.GetPost(context.Background(), grpcReq)
+	resp, err := postServiceClient.GetPost(req.Context(), grpcReq)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get post: %s", err.Error()), http.StatusBadRequest)
+		WritePostServiceError(w, "get post", err)
 		return
 	}
 
@@ -190,42 +153,107 @@ func GetPost(w http.ResponseWriter, req *http.Request) {
 }
 
 func ListPosts(w http.ResponseWriter, req *http.Request) {
-	username, err := Authenticate(req)
+	limit, offset, ok := ParsePage(w, req)
+	if !ok {
+		return
+	}
+
+	viewer, err := RequestViewer(req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		http.Error(w, fmt.Sprintf("Failed to list posts: %s", err.Error()), http.StatusInternalServerError)
 		return
-    }
+	}
+
+	grpcReq := &pb.ListPostsRequest{
+		Limit:  limit,
+		Offset: offset,
+		Viewer: viewer,
+	}
+	// Users see their own deleted posts to restore them.
+	if req.URL.Query().Get("deleted") == "true" {
+		principal := CurrentPrincipal(req)
+		if principal == nil {
+			http.Error(w, "Authentication is required to list deleted posts", http.StatusUnauthorized)
+			return
+		}
+		grpcReq.Username = principal.Username
+		grpcReq.Deleted = true
+	}
 
-	err = CheckUserExists(username)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusNotFound)
-        return
-    }
+	resp, err := postServiceClient.ListPosts(req.Context(), grpcReq)
+	if err != nil {
+		WritePostServiceError(w, "list posts", err)
+		return
+	}
 
-	fmt.Println(fmt.Sprintf("queryyyy %s", req.URL.Query()))
+	json.NewEncoder(w).Encode(resp)
+	w.WriteHeader(http.StatusOK)
+}
 
-	limitStr := req.URL.Query().Get("limit")
-	limit, err := strconv.ParseUint(limitStr, 10, 64)
+func ListPostRevisions(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	postId, err := strconv.ParseUint(params["id"], 10, 64)
 	if err != nil {
-		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	offsetStr := req.URL.Query().Get("offset")
-	offset, err := strconv.ParseUint(offsetStr, 10, 64)
+	limit, offset, ok := ParsePage(w, req)
+	if !ok {
+		return
+	}
+
+	viewer, err := RequestViewer(req)
 	if err != nil {
-		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Failed to list revisions: %s", err.Error()), http.StatusInternalServerError)
 		return
 	}
 
-	grpcReq := &pb.ListPostsRequest{
+	grpcReq := &pb.ListPostRevisionsRequest{
+		PostId: postId,
 		Limit:  limit,
 		Offset: offset,
+		Viewer: viewer,
+	}
+
+	resp, err := postServiceClient.ListPostRevisions(req.Context(), grpcReq)
+	if err != nil {
+		WritePostServiceError(w, "list revisions", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(resp)
+	w.WriteHeader(http.StatusOK)
+}
+
+func GetPostRevision(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	postId, err := strconv.ParseUint(params["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	revision, err := strconv.ParseUint(params["revision"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	viewer, err := RequestViewer(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get revision: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	grpcReq := &pb.GetPostRevisionRequest{
+		PostId:   postId,
+		Revision: revision,
+		Viewer:   viewer,
 	}
 
-	resp, err := postServiceClient.ListPosts(context.Background(), grpcReq)
+	resp, err := postServiceClient.GetPostRevision(req.Context(), grpcReq)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to list posts: %s", err.Error()), http.StatusBadRequest)
+		WritePostServiceError(w, "get revision", err)
 		return
 	}
 
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
+
+	pb "user_service/proto"
+)
+
+// postServiceConfig balances calls over every resolved post_service address
+// and retries the reads, which are safe to repeat, when an instance is gone.
+// Writes are never retried, post_service may have applied them already.
+const postServiceConfig = `{
+	"loadBalancingConfig": [{"round_robin": {}}],
+	"methodConfig": [{
+		"name": [
+			{"service": "PostService", "method": "GetPost"},
+			{"service": "PostService", "method": "ListPosts"},
+			{"service": "PostService", "method": "ListPostRevisions"},
+			{"service": "PostService", "method": "GetPostRevision"}
+		],
+		"retryPolicy": {
+			"maxAttempts": 3,
+			"initialBackoff": "0.1s",
+			"maxBackoff": "1s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}
+	}]
+}`
+
+var errCircuitOpen = errors.New("post service is unavailable")
+
+// postServiceTarget turns the comma-separated addresses into a dial target.
+// A single address is resolved through DNS, so every replica behind the name
+// gets calls. Several addresses are handed to the balancer as they are.
+func postServiceTarget(addrs string) (string, []grpc.DialOption) {
+	var list []string
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			list = append(list, addr)
+		}
+	}
+	if len(list) == 1 {
+		return "dns:///" + list[0], nil
+	}
+
+	state := resolver.State{}
+	for _, addr := range list {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: addr})
+	}
+	r := manual.NewBuilderWithScheme("posts")
+	r.InitialState(state)
+	// The first address is the authority, and so the default TLS server name.
+	return r.Scheme() + ":///" + list[0], []grpc.DialOption{grpc.WithResolvers(r)}
+}
+
+// GRPCDeadline gives calls to post_service the timeout unless the context
+// already ends earlier.
+func GRPCDeadline(timeout time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		deadline, ok := ctx.Deadline()
+		if !ok || time.Until(deadline) > timeout {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// CircuitBreaker opens after Failures calls in a row found post_service
+// unavailable or too slow. While open, calls fail at once. After Cooldown a
+// single call is let through, and its outcome closes or reopens the circuit.
+type CircuitBreaker struct {
+	Failures int
+	Cooldown time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.Cooldown {
+			return false
+		}
+		b.setState(circuitHalfOpen)
+		b.probing = true
+		return true
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// record counts the outcome of an allowed call. Answers from post_service,
+// errors included, show that it is up. Calls cancelled by the caller tell
+// nothing.
+func (b *CircuitBreaker) record(code codes.Code) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch code {
+	case codes.Canceled:
+		b.probing = false
+	case codes.Unavailable, codes.DeadlineExceeded:
+		b.failures++
+		if b.state == circuitHalfOpen || b.failures >= b.Failures {
+			b.openedAt = time.Now()
+			b.probing = false
+			b.setState(circuitOpen)
+		}
+	default:
+		b.failures = 0
+		b.probing = false
+		b.setState(circuitClosed)
+	}
+}
+
+func (b *CircuitBreaker) setState(state circuitState) {
+	if b.state == state {
+		return
+	}
+	slog.Warn("Post service circuit changed", "from", b.state.String(), "to", state.String())
+	b.state = state
+	grpcClientCircuitState.Set(float64(state))
+}
+
+// RetryAfter returns how long the circuit stays open, 0 if it is not.
+func (b *CircuitBreaker) RetryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != circuitOpen {
+		return 0
+	}
+	return max(b.Cooldown-time.Since(b.openedAt), 0)
+}
+
+// Interceptor guards the PostService calls. Health checks pass by, so
+// readiness keeps reporting the real state of post_service.
+func (b *CircuitBreaker) Interceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if !strings.HasPrefix(method, "/"+pb.PostService_ServiceDesc.ServiceName+"/") {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	if !b.allow() {
+		return status.Error(codes.Unavailable, errCircuitOpen.Error())
+	}
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	b.record(status.Code(err))
+	return err
+}
+
+var postServiceBreaker = &CircuitBreaker{Failures: 5, Cooldown: 10 * time.Second}
+
+// WritePostServiceError answers 503 while post_service is unavailable, 504
+// if it did not answer in time and 400 for errors it returned itself.
+func WritePostServiceError(w http.ResponseWriter, action string, err error) {
+	code := http.StatusBadRequest
+	switch status.Code(err) {
+	case codes.Unavailable:
+		code = http.StatusServiceUnavailable
+		retryAfter := postServiceBreaker.RetryAfter()
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(retryAfter.Seconds()))))
+		}
+	case codes.DeadlineExceeded:
+		code = http.StatusGatewayTimeout
+	}
+	http.Error(w, fmt.Sprintf("Failed to %s: %s", action, err.Error()), code)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "user_service/proto"
+)
+
+// breakerStep is one thing happening to a breaker: a call that starts and,
+// unless pending, ends with code, or the cooldown running out.
+type breakerStep struct {
+	cooldown bool
+	code     codes.Code
+	pending  bool
+	finish   bool
+
+	wantAllowed bool
+	wantState   circuitState
+}
+
+func breakerCall(code codes.Code, allowed bool, state circuitState) breakerStep {
+	return breakerStep{code: code, wantAllowed: allowed, wantState: state}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cooldown := breakerStep{cooldown: true, wantState: circuitOpen}
+	tests := []struct {
+		name  string
+		steps []breakerStep
+	}{
+		{"opens after failures in a row", []breakerStep{
+			breakerCall(codes.Unavailable, true, circuitClosed),
+			breakerCall(codes.DeadlineExceeded, true, circuitClosed),
+			breakerCall(codes.Unavailable, true, circuitOpen),
+			breakerCall(codes.OK, false, circuitOpen),
+		}},
+		{"answers reset the failures", []breakerStep{
+			breakerCall(codes.Unavailable, true, circuitClosed),
+			breakerCall(codes.Unavailable, true, circuitClosed),
+			breakerCall(codes.NotFound, true, circuitClosed),
+			breakerCall(codes.Unavailable, true, circuitClosed),
+			breakerCall(codes.Unavailable, true, circuitClosed),
+		}},
+		{"canceled calls do not count", []breakerStep{
+			breakerCall(codes.Unavailable, true, circuitClosed),
+			breakerCall(codes.Unavailable, true, circuitClosed),
+			breakerCall(codes.Canceled, true, circuitClosed),
+			breakerCall(codes.Canceled, true, circuitClosed),
+			breakerCall(codes.Unavailable, true, circuitOpen),
+		}},
+		{"successful probe closes", []breakerStep{
+			breakerCall(codes.Unavailable, true, circuitClosed),
+			breakerCall(codes.Unavailable, true, circuitClosed),
+			breakerCall(codes.Unavailable, true, circuitOpen),
+			cooldown,
+			breakerCall(codes.OK, true, circuitClosed),
+			breakerCall(codes.OK, true, circuitClosed),
+		}},
+		{"failed probe reopens", []breakerStep{
+			breakerCall(codes.Unavailable, true, circuitClosed),
+			breakerCall(codes.Unavailable, true, circuitClosed),
+			breakerCall(codes.Unavailable, true, circuitOpen),
+			cooldown,
+			breakerCall(codes.DeadlineExceeded, true, circuitOpen),
+			breakerCall(codes.OK, false, circuitOpen),
+		}},
+		{"only one probe at a time", []breakerStep{
+			breakerCall(codes.Unavailable, true, circuitClosed),
+			breakerCall(codes.Unavailable, true, circuitClosed),
+			breakerCall(codes.Unavailable, true, circuitOpen),
+			cooldown,
+			{pending: true, wantAllowed: true, wantState: circuitHalfOpen},
+			breakerCall(codes.OK, false, circuitHalfOpen),
+			{finish: true, code: codes.OK, wantState: circuitClosed},
+		}},
+		{"canceled probe lets the next call probe", []breakerStep{
+			breakerCall(codes.Unavailable, true, circuitClosed),
+			breakerCall(codes.Unavailable, true, circuitClosed),
+			breakerCall(codes.Unavailable, true, circuitOpen),
+			cooldown,
+			breakerCall(codes.Canceled, true, circuitHalfOpen),
+			{pending: true, wantAllowed: true, wantState: circuitHalfOpen},
+			breakerCall(codes.OK, false, circuitHalfOpen),
+			{finish: true, code: codes.Unavailable, wantState: circuitOpen},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &CircuitBreaker{Failures: 3, Cooldown: time.Hour}
+			for i, step := range test.steps {
+				switch {
+				case step.cooldown:
+					b.openedAt = time.Now().Add(-b.Cooldown)
+				case step.finish:
+					b.record(step.code)
+				default:
+					allowed := b.allow()
+					if allowed != step.wantAllowed {
+						t.Fatalf("step %d: allowed = %v, want %v", i, allowed, step.wantAllowed)
+					}
+					if allowed && !step.pending {
+						b.record(step.code)
+					}
+				}
+				if b.state != step.wantState {
+					t.Fatalf("step %d: state = %s, want %s", i, b.state, step.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerInterceptor(t *testing.T) {
+	b := &CircuitBreaker{Failures: 1, Cooldown: time.Hour}
+	unavailable := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return status.Error(codes.Unavailable, "connection refused")
+	}
+	method := "/" + pb.PostService_ServiceDesc.ServiceName + "/GetPost"
+
+	err := b.Interceptor(context.Background(), method, nil, nil, nil, unavailable)
+	if status.Code(err) != codes.Unavailable || b.state != circuitOpen {
+		t.Fatalf("first call: err = %v, state = %s", err, b.state)
+	}
+	if b.RetryAfter() <= 0 {
+		t.Errorf("RetryAfter = %s while open", b.RetryAfter())
+	}
+
+	called := false
+	err = b.Interceptor(context.Background(), method, nil, nil, nil, func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		called = true
+		return nil
+	})
+	if called || status.Convert(err).Message() != errCircuitOpen.Error() {
+		t.Errorf("call while open: called = %v, err = %v", called, err)
+	}
+
+	// Health checks must reach post_service even while the circuit is open.
+	err = b.Interceptor(context.Background(), "/grpc.health.v1.Health/Check", nil, nil, nil, func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		called = true
+		return nil
+	})
+	if !called || err != nil {
+		t.Errorf("health check while open: called = %v, err = %v", called, err)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/compress"
+
+	"common/database"
+	"common/logging"
+	"common/metrics"
+	"common/tracing"
+)
+
+type KafkaWriterConfig struct {
+	RequiredAcks string
+	BatchSize    int
+	BatchTimeout time.Duration
+	Compression  string
+}
+
+var kafkaAcks = map[string]kafka.RequiredAcks{
+	"none": kafka.RequireNone,
+	"one":  kafka.RequireOne,
+	"all":  kafka.RequireAll,
+}
+
+var kafkaCompressions = map[string]compress.Compression{
+	"none":   0,
+	"gzip":   compress.Gzip,
+	"snappy": compress.Snappy,
+	"lz4":    compress.Lz4,
+	"zstd":   compress.Zstd,
+}
+
+// NewKafkaWriter returns a writer that sends messages with the same key to
+// the same partition, so their order is kept.
+func NewKafkaWriter(kafkaURL string, topic string, cfg KafkaWriterConfig) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:         kafka.TCP(kafkaURL),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafkaAcks[cfg.RequiredAcks],
+		BatchSize:    cfg.BatchSize,
+		BatchTimeout: cfg.BatchTimeout,
+		Compression:  kafkaCompressions[cfg.Compression],
+	}
+}
+
+// EventPublisher sends like and view events.
+type EventPublisher interface {
+	Publish(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// SyncPublisher writes within the request, which fails if Kafka does.
+type SyncPublisher struct {
+	Writer *kafka.Writer
+}
+
+func (p SyncPublisher) Publish(ctx context.Context, msgs ...kafka.Message) error {
+	return metrics.WriteKafka(ctx, p.Writer, msgs...)
+}
+
+var likePublisher EventPublisher
+var viewPublisher EventPublisher
+
+var ErrSpoolFull = errors.New("Event spool is full")
+
+// Spool stores messages on disk and lets Run deliver them to Kafka in the
+// background, so requests neither wait for Kafka nor fail while it is down.
+// Messages are appended to an open segment, which Run seals and sends as a
+// whole. A segment is deleted only once Kafka took all of it, so messages
+// survive restarts and may be delivered twice, never lost.
+type Spool struct {
+	dir      string
+	writer   *kafka.Writer
+	maxBytes int64
+	// write delivers the messages of one segment, to writer unless replaced.
+	write func(ctx context.Context, msgs []kafka.Message) error
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	nextSeq uint64
+	notify  chan struct{}
+}
+
+const openSegment = "open.jsonl"
+
+type spooledMessage struct {
+	Key     []byte         `json:"key,omitempty"`
+	Value   []byte         `json:"value"`
+	Headers []kafka.Header `json:"headers,omitempty"`
+}
+
+// NewSpool opens the spool of writer's topic below dir. Segments left by a
+// previous run are sent first.
+func NewSpool(dir string, writer *kafka.Writer, maxBytes int64) (*Spool, error) {
+	s := &Spool{
+		dir:      filepath.Join(dir, writer.Topic),
+		writer:   writer,
+		maxBytes: maxBytes,
+		notify:   make(chan struct{}, 1),
+	}
+	s.write = func(ctx context.Context, msgs []kafka.Message) error {
+		return metrics.WriteKafkaMessages(ctx, writer, msgs)
+	}
+	err := os.MkdirAll(s.dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		info, err := os.Stat(filepath.Join(s.dir, segment))
+		if err != nil {
+			return nil, err
+		}
+		s.size += info.Size()
+		seq, _ := strconv.ParseUint(strings.TrimSuffix(segment, ".jsonl"), 10, 64)
+		s.nextSeq = max(s.nextSeq, seq+1)
+	}
+	info, err := os.Stat(filepath.Join(s.dir, openSegment))
+	if err == nil {
+		s.size += info.Size()
+		err = s.seal()
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	kafkaSpoolBytes.WithLabelValues(writer.Topic).Set(float64(s.size))
+	return s, nil
+}
+
+// Publish appends msgs to the spool. The request and trace IDs of ctx are
+// stored with them.
+func (s *Spool) Publish(ctx context.Context, msgs ...kafka.Message) error {
+	logging.SetMessageRequestID(ctx, msgs)
+	_, span := tracing.StartKafkaPublish(ctx, s.writer.Topic, msgs)
+
+	var buf []byte
+	for _, msg := range msgs {
+		line, err := json.Marshal(spooledMessage{Key: msg.Key, Value: msg.Value, Headers: msg.Headers})
+		if err != nil {
+			tracing.EndSpan(span, err)
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	err := s.append(buf)
+	tracing.EndSpan(span, err)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *Spool) append(buf []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxBytes > 0 && s.size+int64(len(buf)) > s.maxBytes {
+		return ErrSpoolFull
+	}
+	if s.file == nil {
+		file, err := os.OpenFile(filepath.Join(s.dir, openSegment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		s.file = file
+	}
+
+	_, err := s.file.Write(buf)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	s.size += int64(len(buf))
+	kafkaSpoolBytes.WithLabelValues(s.writer.Topic).Set(float64(s.size))
+	return nil
+}
+
+// seal turns the open segment into the next numbered one. The caller holds
+// s.mu, or is the only user of s.
+func (s *Spool) seal() error {
+	if s.file != nil {
+		err := s.file.Close()
+		s.file = nil
+		if err != nil {
+			return err
+		}
+	}
+	err := os.Rename(filepath.Join(s.dir, openSegment), filepath.Join(s.dir, fmt.Sprintf("%020d.jsonl", s.nextSeq)))
+	if err != nil {
+		return err
+	}
+	s.nextSeq++
+	return nil
+}
+
+// segments lists the sealed segments, oldest first.
+func (s *Spool) segments() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, entry := range entries {
+		if entry.Name() != openSegment && strings.HasSuffix(entry.Name(), ".jsonl") {
+			segments = append(segments, entry.Name())
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// Run sends spooled messages until ctx is cancelled. While Kafka is down it
+// retries with backoff, what is not sent by then stays for the next start.
+func (s *Spool) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	backoff := database.Backoff{Initial: time.Second, Max: time.Minute}
+
+	for attempt := 0; ; {
+		select {
+		case <-ctx.Done():
+			s.close()
+			return
+		case <-ticker.C:
+		case <-s.notify:
+		}
+
+		err := s.flush(ctx)
+		if err == nil {
+			attempt = 0
+			continue
+		}
+		if ctx.Err() != nil {
+			s.close()
+			return
+		}
+
+		delay := backoff.Delay(attempt)
+		attempt++
+		slog.WarnContext(ctx, "Failed to deliver spooled events", "topic", s.writer.Topic, "retry_in", delay, "error", err)
+		if database.Sleep(ctx, delay) != nil {
+			s.close()
+			return
+		}
+	}
+}
+
+// flush seals the open segment and sends every sealed one.
+func (s *Spool) flush(ctx context.Context) error {
+	s.mu.Lock()
+	var err error
+	if s.file != nil {
+		err = s.seal()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		err = s.send(ctx, filepath.Join(s.dir, segment))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Spool) send(ctx context.Context, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var msgs []kafka.Message
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var msg spooledMessage
+		err = json.Unmarshal(scanner.Bytes(), &msg)
+		if err != nil {
+			// A line cut short by a crash is dropped, the rest is kept.
+			slog.WarnContext(ctx, "Skipping broken spooled event", "topic", s.writer.Topic, "segment", path, "error", err)
+			continue
+		}
+		msgs = append(msgs, kafka.Message{Key: msg.Key, Value: msg.Value, Headers: msg.Headers})
+	}
+	if scanner.Err() != nil {
+		return scanner.Err()
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if len(msgs) > 0 {
+		err = s.write(ctx, msgs)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.size -= info.Size()
+	kafkaSpoolBytes.WithLabelValues(s.writer.Topic).Set(float64(s.size))
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Spool) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
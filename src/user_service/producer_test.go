@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func newTestSpool(t *testing.T, dir string, maxBytes int64) *Spool {
+	t.Helper()
+	s, err := NewSpool(dir, &kafka.Writer{Topic: "events"}, maxBytes)
+	if err != nil {
+		t.Fatalf("NewSpool: %v", err)
+	}
+	t.Cleanup(s.close)
+	return s
+}
+
+func writeSegment(t *testing.T, dir, name, content string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Join(dir, "events"), 0o700)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "events", name), []byte(content), 0o600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func spoolFiles(t *testing.T, s *Spool) []string {
+	t.Helper()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestNewSpoolSealsOpenSegment(t *testing.T) {
+	dir := t.TempDir()
+	sealed := `{"value":"YQ=="}` + "\n"
+	crashed := `{"value":"Yg=="}` + "\n" + `{"val`
+	writeSegment(t, dir, "00000000000000000007.jsonl", sealed)
+	writeSegment(t, dir, openSegment, crashed)
+
+	s := newTestSpool(t, dir, 0)
+
+	want := []string{"00000000000000000007.jsonl", "00000000000000000008.jsonl"}
+	if got := spoolFiles(t, s); !slices.Equal(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+	if want := int64(len(sealed) + len(crashed)); s.size != want {
+		t.Errorf("size = %d, want %d", s.size, want)
+	}
+
+	err := s.Publish(context.Background(), kafka.Message{Value: []byte("c")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.write = func(ctx context.Context, msgs []kafka.Message) error {
+		return errors.New("kafka is down")
+	}
+	err = s.flush(context.Background())
+	if err == nil {
+		t.Fatal("flush succeeded while Kafka is down")
+	}
+	want = append(want, "00000000000000000009.jsonl")
+	if got := spoolFiles(t, s); !slices.Equal(got, want) {
+		t.Errorf("files after publish = %v, want %v", got, want)
+	}
+}
+
+func TestSpoolSend(t *testing.T) {
+	tests := []struct {
+		name        string
+		segment     string
+		writeErr    error
+		wantValues  []string
+		wantRemoved bool
+	}{
+		{
+			name:        "written",
+			segment:     `{"value":"YQ=="}` + "\n" + `{"value":"Yg=="}` + "\n",
+			wantValues:  []string{"a", "b"},
+			wantRemoved: true,
+		},
+		{
+			name:        "truncated last line",
+			segment:     `{"value":"YQ=="}` + "\n" + `{"value":"Yg`,
+			wantValues:  []string{"a"},
+			wantRemoved: true,
+		},
+		{
+			name:        "only a truncated line",
+			segment:     `{"val`,
+			wantRemoved: true,
+		},
+		{
+			name:       "write failed",
+			segment:    `{"value":"YQ=="}` + "\n",
+			writeErr:   errors.New("kafka is down"),
+			wantValues: []string{"a"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeSegment(t, dir, "00000000000000000000.jsonl", test.segment)
+			s := newTestSpool(t, dir, 0)
+
+			var values []string
+			s.write = func(ctx context.Context, msgs []kafka.Message) error {
+				for _, msg := range msgs {
+					values = append(values, string(msg.Value))
+				}
+				return test.writeErr
+			}
+			err := s.flush(context.Background())
+
+			if !errors.Is(err, test.writeErr) {
+				t.Errorf("flush = %v, want %v", err, test.writeErr)
+			}
+			if !slices.Equal(values, test.wantValues) {
+				t.Errorf("written = %q, want %q", values, test.wantValues)
+			}
+			files := spoolFiles(t, s)
+			if removed := len(files) == 0; removed != test.wantRemoved {
+				t.Errorf("segment removed = %v, want %v, files %v", removed, test.wantRemoved, files)
+			}
+			wantSize := int64(len(test.segment))
+			if test.wantRemoved {
+				wantSize = 0
+			}
+			if s.size != wantSize {
+				t.Errorf("size = %d, want %d", s.size, wantSize)
+			}
+		})
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	// Every message takes 17 bytes: {"value":"YQ=="} and a newline.
+	s := newTestSpool(t, t.TempDir(), 40)
+	msg := kafka.Message{Value: []byte("a")}
+
+	for i := 0; i < 2; i++ {
+		err := s.Publish(context.Background(), msg)
+		if err != nil {
+			t.Fatalf("publish %d: %v", i, err)
+		}
+	}
+	err := s.Publish(context.Background(), msg)
+	if !errors.Is(err, ErrSpoolFull) {
+		t.Fatalf("publish over the limit = %v, want ErrSpoolFull", err)
+	}
+	if s.size != 34 {
+		t.Errorf("size = %d, want 34", s.size)
+	}
+
+	s.write = func(ctx context.Context, msgs []kafka.Message) error {
+		return nil
+	}
+	err = s.flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Publish(context.Background(), msg)
+	if err != nil {
+		t.Errorf("publish after flush: %v", err)
+	}
+}
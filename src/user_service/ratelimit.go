@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/gorilla/mux"
+
+	"common/database"
+)
+
+// Quota is a token bucket: it holds up to Limit requests and refills Limit
+// tokens every Period.
+type Quota struct {
+	Limit  int
+	Period time.Duration
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+	// Reset is how long it takes until the bucket is full again.
+	Reset time.Duration
+}
+
+// ParseQuota parses quotas like "10/1m" or "100/h".
+func ParseQuota(s string) (Quota, error) {
+	limit, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return Quota{}, fmt.Errorf("invalid quota %q, expected <limit>/<period>", s)
+	}
+
+	quota := Quota{}
+	var err error
+	quota.Limit, err = strconv.Atoi(limit)
+	if err != nil || quota.Limit <= 0 {
+		return Quota{}, fmt.Errorf("invalid limit in quota %q", s)
+	}
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	quota.Period, err = time.ParseDuration(period)
+	if err != nil || quota.Period <= 0 {
+		return Quota{}, fmt.Errorf("invalid period in quota %q", s)
+	}
+	return quota, nil
+}
+
+// ParseQuotas parses a comma-separated list of route=quota pairs.
+func ParseQuotas(s string) (map[string]Quota, error) {
+	quotas := map[string]Quota{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q, expected <route>=<quota>", entry)
+		}
+		quota, err := ParseQuota(value)
+		if err != nil {
+			return nil, err
+		}
+		quotas[strings.TrimSpace(route)] = quota
+	}
+	return quotas, nil
+}
+
+func (q Quota) rate() float64 {
+	return float64(q.Limit) / q.Period.Seconds()
+}
+
+// take refills a bucket that had the given tokens elapsed ago and takes one
+// token from it if there is one.
+func (q Quota) take(tokens float64, elapsed time.Duration) (float64, RateLimitResult) {
+	tokens = math.Min(float64(q.Limit), tokens+elapsed.Seconds()*q.rate())
+
+	result := RateLimitResult{}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - tokens) / q.rate() * float64(time.Second))
+	}
+	result.Remaining = int(tokens)
+	result.Reset = time.Duration((float64(q.Limit) - tokens) / q.rate() * float64(time.Second))
+	return tokens, result
+}
+
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, quota Quota) (RateLimitResult, error)
+}
+
+type rateLimitBucket struct {
+	tokens  float64
+	updated time.Time
+	period  time.Duration
+}
+
+const rateLimitSweepInterval = time.Minute
+
+// MemoryRateLimitStore keeps buckets in the process, so every replica
+// limits on its own.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*rateLimitBucket
+	lastSweep time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets:   map[string]*rateLimitBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, quota Quota) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	// Buckets idle for a whole period are full and can be forgotten.
+	if now.Sub(s.lastSweep) >= rateLimitSweepInterval {
+		for k, bucket := range s.buckets {
+			if now.Sub(bucket.updated) >= bucket.period {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &rateLimitBucket{
+			tokens:  float64(quota.Limit),
+			updated: now,
+			period:  quota.Period,
+		}
+		s.buckets[key] = bucket
+	}
+
+	tokens, result := quota.take(bucket.tokens, now.Sub(bucket.updated))
+	bucket.tokens = tokens
+	bucket.updated = now
+	return result, nil
+}
+
+// PostgresRateLimitStore keeps buckets in the rateLimits table, so all
+// replicas share them.
+type PostgresRateLimitStore struct {
+	db *sql.DB
+}
+
+func NewPostgresRateLimitStore(db *sql.DB) *PostgresRateLimitStore {
+	return &PostgresRateLimitStore{db: db}
+}
+
+func (s *PostgresRateLimitStore) Take(ctx context.Context, key string, quota Quota) (RateLimitResult, error) {
+	var result RateLimitResult
+	err := database.RunInTx(ctx, s.db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "INSERT INTO rateLimits(key, tokens, updatedAt) VALUES($1, $2, now()) ON CONFLICT (key) DO NOTHING",
+			key, quota.Limit)
+		if err != nil {
+			return err
+		}
+
+		var tokens, seconds float64
+		err = tx.QueryRowContext(ctx, "SELECT tokens, EXTRACT(EPOCH FROM now() - updatedAt) FROM rateLimits WHERE key=$1 FOR UPDATE",
+			key).Scan(&tokens, &seconds)
+		if err != nil {
+			return err
+		}
+
+		tokens, result = quota.take(tokens, time.Duration(seconds*float64(time.Second)))
+		_, err = tx.ExecContext(ctx, "UPDATE rateLimits SET tokens=$1, updatedAt=now() WHERE key=$2", tokens, key)
+		return err
+	})
+	return result, err
+}
+
+var rateLimitStore RateLimitStore
+var rateLimitQuotas map[string]Quota
+
+// rateLimitSubject identifies the client: the user of a valid access token,
+// otherwise the client address. The token is only verified, not looked up,
+// so limiting does not cost a database query.
+func rateLimitSubject(req *http.Request) string {
+	token, err := Authenticate(req)
+	if err == nil {
+		return "user:" + token.Username
+	}
+	return "ip:" + ClientIP(req)
+}
+
+// RateLimit limits the requests to every named route that has a quota.
+func RateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := mux.CurrentRoute(req)
+		if route == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		quota, ok := rateLimitQuotas[route.GetName()]
+		if !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		key := route.GetName() + ":" + rateLimitSubject(req)
+		result, err := rateLimitStore.Take(req.Context(), key, quota)
+		if err != nil {
+			// A broken limiter should not take the API down with it.
+			if !errors.Is(err, context.Canceled) {
+				slog.ErrorContext(req.Context(), "Failed to check rate limit", "key", key, "error", err)
+			}
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(quota.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(result.Reset.Seconds())), 10))
+		if !result.Allowed {
+			TooManyRequests(w, result.RetryAfter, "Rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+var maxBodySize int64 = 1 << 20
+
+// maxPageSize is the largest limit a list endpoint accepts.
+const maxPageSize = 100
+
+// DecodeJSON reads the whole JSON body of the request into v. Unknown fields,
+// trailing data and bodies over maxBodySize are rejected. On failure the
+// error response is already written and false is returned.
+func DecodeJSON(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	defer req.Body.Close()
+
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(v)
+	if err == nil {
+		// A second value, or garbage after the first one, is not a valid body.
+		err = decoder.Decode(&struct{}{})
+		if err == io.EOF {
+			return true
+		}
+		if err == nil {
+			err = errors.New("body must contain a single JSON value")
+		}
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		http.Error(w, fmt.Sprintf("Request body must not be larger than %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, io.EOF):
+		http.Error(w, "Request body is empty", http.StatusBadRequest)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		http.Error(w, "Request body is truncated JSON", http.StatusBadRequest)
+	case errors.As(err, &syntaxErr):
+		http.Error(w, fmt.Sprintf("Request body is invalid JSON at offset %d", syntaxErr.Offset), http.StatusBadRequest)
+	case errors.As(err, &typeErr):
+		http.Error(w, fmt.Sprintf("Field %q must be %s", typeErr.Field, typeErr.Type), http.StatusBadRequest)
+	default:
+		http.Error(w, fmt.Sprintf("Invalid request body: %s", err.Error()), http.StatusBadRequest)
+	}
+	return false
+}
+
+// ParsePage reads the limit and offset query parameters of list endpoints.
+// On failure the error response is already written and false is returned.
+func ParsePage(w http.ResponseWriter, req *http.Request) (uint64, uint64, bool) {
+	limit, err := strconv.ParseUint(req.URL.Query().Get("limit"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	if limit > maxPageSize {
+		http.Error(w, fmt.Sprintf("Limit must not be larger than %d", maxPageSize), http.StatusBadRequest)
+		return 0, 0, false
+	}
+
+	offset, err := strconv.ParseUint(req.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return limit, offset, true
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+type Permission string
+
+const (
+	PermissionModeratePosts Permission = "posts:moderate"
+	PermissionBanUsers      Permission = "users:ban"
+	PermissionListUsers     Permission = "users:list"
+	PermissionManageRoles   Permission = "users:roles"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleUser: {},
+	RoleModerator: {
+		PermissionModeratePosts,
+	},
+	RoleAdmin: {
+		PermissionModeratePosts,
+		PermissionBanUsers,
+		PermissionListUsers,
+		PermissionManageRoles,
+	},
+}
+
+func ParseRole(role string) (Role, error) {
+	_, ok := rolePermissions[Role(role)]
+	if !ok {
+		return "", fmt.Errorf("Unknown role %q", role)
+	}
+	return Role(role), nil
+}
+
+func (r Role) Can(permission Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission must be used after RequireAuth.
+func RequirePermission(permission Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			principal := CurrentPrincipal(req)
+			if principal == nil || !principal.Role.Can(permission) {
+				http.Error(w, "Permission denied", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"common/database"
+)
+
+// sessionCache maps live session ids to their user id. Revocations made by
+// another replica are noticed once the entry expires.
+var sessionCache = NewTTLCache[uint64](0)
+
+func NewRandomId() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken is used for single-use secrets that are stored only as hashes.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func CreateSession(userId uint64) (string, error) {
+	sessionId, err := NewRandomId()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec("INSERT INTO sessions(id, userId) VALUES($1, $2)", sessionId, userId)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create session: %w", err)
+	}
+	return sessionId, nil
+}
+
+func CheckSession(ctx context.Context, sessionId string, userId uint64) error {
+	cachedUserId, ok := sessionCache.Get(sessionId)
+	if ok && cachedUserId == userId {
+		return nil
+	}
+
+	var exists bool
+	err := database.Retry(ctx, func() error {
+		return db.QueryRowContext(ctx, "SELECT exists (SELECT 1 FROM sessions WHERE id=$1 AND userId=$2 AND revokedAt IS NULL)",
+			sessionId, userId).Scan(&exists)
+	})
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("Session expired")
+	}
+
+	sessionCache.Put(sessionId, userId)
+	return nil
+}
+
+// RevokeSessions revokes all sessions of the user except the given one,
+// which may be empty to revoke every session.
+func RevokeSessions(userId uint64, except string) error {
+	_, err := db.Exec("UPDATE sessions SET revokedAt=now() WHERE userId=$1 AND id<>$2 AND revokedAt IS NULL",
+		userId, except)
+	if err != nil {
+		return fmt.Errorf("Failed to revoke sessions: %w", err)
+	}
+
+	sessionCache.InvalidateFunc(func(sessionId string, sessionUserId uint64) bool {
+		return sessionUserId == userId && sessionId != except
+	})
+	return nil
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	_ "github.com/lib/pq"
+	"github.com/gorilla/mux"
 	"github.com/segmentio/kafka-go"
+
+	pb "user_service/proto"
 )
 
 type Event struct {
@@ -15,18 +19,38 @@ type Event struct {
 	Username string `json:"username"`
 }
 
-func Like(w http.ResponseWriter, req *http.Request) {
-	username, err := Authenticate(req)
+// requireVisiblePost answers the request and returns false unless the caller
+// may see the post, only visible posts can be liked or viewed.
+func requireVisiblePost(w http.ResponseWriter, req *http.Request) bool {
+	postId, err := strconv.ParseUint(mux.Vars(req)["id"], 10, 64)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-    }
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
 
-	err = CheckUserExists(username)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusNotFound)
-        return
-    }
+	viewer, err := RequestViewer(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get post: %s", err.Error()), http.StatusInternalServerError)
+		return false
+	}
+
+	_, err = postServiceClient.GetPost(req.Context(), &pb.GetPostRequest{
+		Id:     postId,
+		Viewer: viewer,
+	})
+	if err != nil {
+		WritePostServiceError(w, "get post", err)
+		return false
+	}
+	return true
+}
+
+func Like(w http.ResponseWriter, req *http.Request) {
+	username := CurrentPrincipal(req).Username
+
+	if !requireVisiblePost(w, req) {
+		return
+	}
 
 	params := mux.Vars(req)
 	event := Event{
@@ -40,12 +64,17 @@ func Like(w http.ResponseWriter, req *http.Request) {
 		return
  	}
 
-	err = kafkaLikeWriter.WriteMessages(context.Background(), kafka.Message{
+	err = likePublisher.Publish(req.Context(), kafka.Message{
+		Key:   []byte(event.PostId),
 		Value: msg,
 	})
 
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to send message to Kafka: %s", err.Error()), http.StatusBadRequest)
+		code := http.StatusBadRequest
+		if errors.Is(err, ErrSpoolFull) {
+			code = http.StatusServiceUnavailable
+		}
+		http.Error(w, fmt.Sprintf("Failed to send message to Kafka: %s", err.Error()), code)
 		return
 	}
 
@@ -53,17 +82,11 @@ func Like(w http.ResponseWriter, req *http.Request) {
 }
 
 func View(w http.ResponseWriter, req *http.Request) {
-	username, err := Authenticate(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-    }
+	username := CurrentPrincipal(req).Username
 
-	err = CheckUserExists(username)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusNotFound)
-        return
-    }
+	if !requireVisiblePost(w, req) {
+		return
+	}
 
 	params := mux.Vars(req)
 	event := Event{
@@ -77,12 +100,17 @@ func View(w http.ResponseWriter, req *http.Request) {
 		return
  	}
 
-	err = kafkaViewWriter.WriteMessages(context.Background(), kafka.Message{
+	err = viewPublisher.Publish(req.Context(), kafka.Message{
+		Key:   []byte(event.PostId),
 		Value: msg,
 	})
 
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to send message to Kafka: %s", err.Error()), http.StatusBadRequest)
+		code := http.StatusBadRequest
+		if errors.Is(err, ErrSpoolFull) {
+			code = http.StatusServiceUnavailable
+		}
+		http.Error(w, fmt.Sprintf("Failed to send message to Kafka: %s", err.Error()), code)
 		return
 	}
 
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// ThrottlePolicy describes how failed attempts are punished: the first
+// FreeAttempts failures cost nothing, every further one doubles the lockout,
+// starting at BaseDelay and capped at MaxDelay. Failures are forgotten after
+// Window without new ones.
+type ThrottlePolicy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Window       time.Duration
+}
+
+func (p ThrottlePolicy) Lockout(failures int) time.Duration {
+	excess := failures - p.FreeAttempts
+	if excess <= 0 {
+		return 0
+	}
+	if excess > 30 {
+		return p.MaxDelay
+	}
+	delay := p.BaseDelay << (excess - 1)
+	if delay > p.MaxDelay || delay <= 0 {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// remaining returns how long a key is locked given its failures and the time
+// since the last one.
+func (p ThrottlePolicy) remaining(failures int, sinceLastFailure time.Duration) time.Duration {
+	if sinceLastFailure >= p.Window {
+		return 0
+	}
+	wait := p.Lockout(failures) - sinceLastFailure
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// LoginThrottle counts failed login attempts per key, e.g. per username or
+// per client address.
+type LoginThrottle interface {
+	// Check returns how long the key is still locked out.
+	Check(ctx context.Context, key string) (time.Duration, error)
+	// Fail records a failed attempt and returns the resulting lockout.
+	Fail(ctx context.Context, key string) (time.Duration, error)
+	Reset(ctx context.Context, key string) error
+}
+
+type throttleEntry struct {
+	failures    int
+	lastFailure time.Time
+}
+
+// MemoryLoginThrottle keeps counters in the process, so every replica
+// counts on its own.
+type MemoryLoginThrottle struct {
+	policy ThrottlePolicy
+
+	mu      sync.Mutex
+	entries map[string]*throttleEntry
+}
+
+func NewMemoryLoginThrottle(policy ThrottlePolicy) *MemoryLoginThrottle {
+	return &MemoryLoginThrottle{
+		policy:  policy,
+		entries: map[string]*throttleEntry{},
+	}
+}
+
+func (t *MemoryLoginThrottle) Check(ctx context.Context, key string) (time.Duration, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[key]
+	if !ok {
+		return 0, nil
+	}
+	return t.policy.remaining(entry.failures, time.Since(entry.lastFailure)), nil
+}
+
+func (t *MemoryLoginThrottle) Fail(ctx context.Context, key string) (time.Duration, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range t.entries {
+		if now.Sub(entry.lastFailure) >= t.policy.Window {
+			delete(t.entries, k)
+		}
+	}
+
+	entry, ok := t.entries[key]
+	if !ok {
+		entry = &throttleEntry{}
+		t.entries[key] = entry
+	}
+	entry.failures++
+	entry.lastFailure = now
+	return t.policy.Lockout(entry.failures), nil
+}
+
+func (t *MemoryLoginThrottle) Reset(ctx context.Context, key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+	return nil
+}
+
+// PostgresLoginThrottle keeps counters in the loginAttempts table, so all
+// replicas share them. Time is taken from the database to avoid clock skew
+// between replicas.
+type PostgresLoginThrottle struct {
+	policy ThrottlePolicy
+	db     *sql.DB
+}
+
+func NewPostgresLoginThrottle(policy ThrottlePolicy, db *sql.DB) *PostgresLoginThrottle {
+	return &PostgresLoginThrottle{
+		policy: policy,
+		db:     db,
+	}
+}
+
+func (t *PostgresLoginThrottle) Check(ctx context.Context, key string) (time.Duration, error) {
+	var failures int
+	var seconds float64
+	err := t.db.QueryRowContext(ctx, "SELECT failures, EXTRACT(EPOCH FROM now() - lastFailureAt) FROM loginAttempts WHERE key=$1",
+		key).Scan(&failures, &seconds)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return t.policy.remaining(failures, time.Duration(seconds*float64(time.Second))), nil
+}
+
+func (t *PostgresLoginThrottle) Fail(ctx context.Context, key string) (time.Duration, error) {
+	var failures int
+	err := t.db.QueryRowContext(ctx, `
+		INSERT INTO loginAttempts(key, failures, lastFailureAt) VALUES($1, 1, now())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN loginAttempts.lastFailureAt < now() - make_interval(secs => $2) THEN 1
+				ELSE loginAttempts.failures + 1
+			END,
+			lastFailureAt = now()
+		RETURNING failures
+	`, key, t.policy.Window.Seconds()).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+	return t.policy.Lockout(failures), nil
+}
+
+func (t *PostgresLoginThrottle) Reset(ctx context.Context, key string) error {
+	_, err := t.db.ExecContext(ctx, "DELETE FROM loginAttempts WHERE key=$1", key)
+	return err
+}
+
+var userLoginThrottle LoginThrottle
+var ipLoginThrottle LoginThrottle
+
+func ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// LoginAttempt throttles one login step. Failures are counted both for the
+// account and for the client address, so neither guessing many passwords of
+// one user nor one password of many users is fast.
+type LoginAttempt struct {
+	userKey string
+	ipKey   string
+}
+
+func NewLoginAttempt(req *http.Request, userKey string) LoginAttempt {
+	return LoginAttempt{
+		userKey: userKey,
+		ipKey:   "ip:" + ClientIP(req),
+	}
+}
+
+// Allow writes a 429 response and returns false if the attempt is locked out.
+func (a LoginAttempt) Allow(w http.ResponseWriter, req *http.Request) bool {
+	userWait, err := userLoginThrottle.Check(req.Context(), a.userKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to check login attempts: %s", err.Error()), http.StatusInternalServerError)
+		return false
+	}
+	ipWait, err := ipLoginThrottle.Check(req.Context(), a.ipKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to check login attempts: %s", err.Error()), http.StatusInternalServerError)
+		return false
+	}
+
+	wait := max(userWait, ipWait)
+	if wait > 0 {
+		TooManyRequests(w, wait, "Too many failed login attempts")
+		return false
+	}
+	return true
+}
+
+func (a LoginAttempt) Fail(req *http.Request) {
+	_, err := userLoginThrottle.Fail(req.Context(), a.userKey)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Failed to record login attempt", "error", err)
+	}
+	_, err = ipLoginThrottle.Fail(req.Context(), a.ipKey)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Failed to record login attempt", "error", err)
+	}
+}
+
+// Succeed only resets the account counter, a client address that guessed
+// other accounts stays suspicious.
+func (a LoginAttempt) Succeed(req *http.Request) {
+	err := userLoginThrottle.Reset(req.Context(), a.userKey)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Failed to reset login attempts", "error", err)
+	}
+}
+
+func TooManyRequests(w http.ResponseWriter, wait time.Duration, message string) {
+	w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(wait.Seconds()))))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
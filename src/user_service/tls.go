@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	"google.golang.org/grpc/credentials"
+
+	"common/certs"
+)
+
+func NewPostServiceCredentials(caFile string, certFile string, keyFile string, serverName string) (credentials.TransportCredentials, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("Both TLS certificate and key are required for the post server client")
+	}
+
+	reloader, err := certs.NewReloader(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if certFile != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.Certificate(), nil
+		}
+	}
+	if caFile != "" {
+		// The CA pool is reloaded together with the certificate, so the
+		// chain is verified here instead of through a fixed RootCAs.
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("No server certificate")
+			}
+			opts := x509.VerifyOptions{
+				Roots:         reloader.CAPool(),
+				DNSName:       state.ServerName,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range state.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+	return credentials.NewTLS(config), nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"common/database"
+)
+
+const (
+	PurposeMFA = "mfa"
+
+	totpIssuer        = "Social Network"
+	recoveryCodeCount = 10
+)
+
+var mfaTokenTTL time.Duration
+
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfaRequired"`
+	MFAToken    string `json:"mfaToken"`
+}
+
+type MFALogin struct {
+	MFAToken string `json:"mfaToken"`
+	Code     string `json:"code"`
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TOTPCode struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckSecondFactor accepts either a current TOTP code or an unused recovery
+// code. Both can be used only once.
+func CheckSecondFactor(userId uint64, code string) error {
+	code = strings.TrimSpace(code)
+
+	if isTOTPCode(code) {
+		var secret string
+		err := db.QueryRow("SELECT totpSecret FROM users WHERE id=$1 AND totpEnabled", userId).Scan(&secret)
+		if err != nil {
+			return errors.New("Two-factor authentication is not enabled")
+		}
+
+		step, ok := ValidateTOTP(secret, code, time.Now())
+		if !ok {
+			return errors.New("Invalid code")
+		}
+
+		result, err := db.Exec("UPDATE users SET totpLastStep=$1 WHERE id=$2 AND totpLastStep < $1", step, userId)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return errors.New("Code already used")
+		}
+		return nil
+	}
+
+	result, err := db.Exec("UPDATE recoveryCodes SET usedAt=now() WHERE userId=$1 AND codeHash=$2 AND usedAt IS NULL",
+		userId, HashToken(NormalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return errors.New("Invalid code")
+	}
+	return nil
+}
+
+func readTOTPCode(w http.ResponseWriter, req *http.Request) (string, bool) {
+	code := TOTPCode{}
+	if !DecodeJSON(w, req, &code) {
+		return "", false
+	}
+	return code.Code, true
+}
+
+func EnrollTOTP(w http.ResponseWriter, req *http.Request) {
+	principal := CurrentPrincipal(req)
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A pending secret is replaced until the enrollment is confirmed.
+	result, err := db.Exec("UPDATE users SET totpSecret=$1 WHERE id=$2 AND NOT totpEnabled", secret, principal.Id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to enroll: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TOTPEnrollment{
+		Secret: secret,
+		URI:    TOTPProvisioningURI(totpIssuer, principal.Username, secret),
+	})
+}
+
+func ConfirmTOTP(w http.ResponseWriter, req *http.Request) {
+	principal := CurrentPrincipal(req)
+
+	code, ok := readTOTPCode(w, req)
+	if !ok {
+		return
+	}
+
+	var secret *string
+	var enabled bool
+	err := db.QueryRow("SELECT totpSecret, totpEnabled FROM users WHERE id=$1", principal.Id).Scan(&secret, &enabled)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if secret == nil {
+		http.Error(w, "Enrollment was not started", http.StatusBadRequest)
+		return
+	}
+
+	step, ok := ValidateTOTP(*secret, code, time.Now())
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i], err = GenerateRecoveryCode()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = database.RunInTx(req.Context(), db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(req.Context(), "UPDATE users SET totpEnabled=TRUE, totpLastStep=$1 WHERE id=$2", step, principal.Id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(req.Context(), "DELETE FROM recoveryCodes WHERE userId=$1", principal.Id)
+		if err != nil {
+			return err
+		}
+
+		for _, recoveryCode := range codes {
+			_, err = tx.ExecContext(req.Context(), "INSERT INTO recoveryCodes(userId, codeHash) VALUES($1, $2)",
+				principal.Id, HashToken(NormalizeRecoveryCode(recoveryCode)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to enable two-factor authentication: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodes{RecoveryCodes: codes})
+}
+
+func DisableTOTP(w http.ResponseWriter, req *http.Request) {
+	principal := CurrentPrincipal(req)
+
+	code, ok := readTOTPCode(w, req)
+	if !ok {
+		return
+	}
+
+	err := CheckSecondFactor(principal.Id, code)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	err = database.RunInTx(req.Context(), db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(req.Context(), "UPDATE users SET totpEnabled=FALSE, totpSecret=NULL, totpLastStep=0 WHERE id=$1", principal.Id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(req.Context(), "DELETE FROM recoveryCodes WHERE userId=$1", principal.Id)
+		return err
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to disable two-factor authentication: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// LoginSecondFactor exchanges the mfa_token returned by LoginUser and a code
+// for an access token.
+func LoginSecondFactor(w http.ResponseWriter, req *http.Request) {
+	login := MFALogin{}
+	if !DecodeJSON(w, req, &login) {
+		return
+	}
+
+	claims, err := ParseToken(login.MFAToken, PurposeMFA)
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+	uid, ok := claims["uid"].(float64)
+	if !ok {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+	userId := uint64(uid)
+
+	var username string
+	var role Role
+	var banned bool
+	err = db.QueryRow("SELECT username, role, banned FROM users WHERE id=$1 AND deletedAt IS NULL", userId).
+		Scan(&username, &role, &banned)
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+	if banned {
+		http.Error(w, "User is banned", http.StatusForbidden)
+		return
+	}
+
+	// The password step is already passed, codes are counted on their own key
+	// so guessing them is throttled as well.
+	attempt := NewLoginAttempt(req, fmt.Sprintf("mfa:%d", userId))
+	if !attempt.Allow(w, req) {
+		return
+	}
+
+	err = CheckSecondFactor(userId, login.Code)
+	if err != nil {
+		attempt.Fail(req)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	attempt.Succeed(req)
+
+	IssueAccessToken(w, userId, username, role)
+}
@@ -2,19 +2,25 @@ package main
 
 import (
 	"crypto/md5"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"io"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/golang-jwt/jwt/v5"
+
+	"common/database"
 )
 
 type User struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Email    string `json:"email"`
 }
 
 type UserInfo struct {
@@ -35,72 +41,120 @@ func HashPassword(username string, password string) string {
 }
 
 func RegisterUser(w http.ResponseWriter, req *http.Request) {
-	body := make([]byte, req.ContentLength)
-	_, err := req.Body.Read(body)
-	defer req.Body.Close()
-	if err != io.EOF {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	user := User{}
+	if !DecodeJSON(w, req, &user) {
 		return
 	}
 
-	user := User{}
-	err = json.Unmarshal(body, &user)
+	validation := &ValidationErrors{}
+	ValidateUsername(validation, user.Username)
+	ValidatePassword(validation, "password", user.Username, user.Password)
+	err := ValidateEmail(user.Email)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		validation.Add("email", "invalid", err.Error())
+	}
+	if !validation.Empty() {
+		WriteValidationErrors(w, http.StatusBadRequest, validation)
 		return
 	}
 
-	var exists bool
-    db.QueryRow("SELECT exists (SELECT 1 FROM users WHERE username=$1)", user.Username).Scan(&exists)
-    if exists {
-        http.Error(w, "Username already exists", http.StatusConflict)
-        return
-    }
-
+	var userId uint64
 	passwordHash := HashPassword(user.Username, user.Password)
-	_, err = db.Exec("INSERT INTO users(username, password) VALUES($1, $2)", user.Username, passwordHash)
+	err = db.QueryRow("INSERT INTO users(username, password, role, mail) VALUES($1, $2, $3, $4) RETURNING id",
+		user.Username, passwordHash, RoleUser, user.Email).Scan(&userId)
+	if isUniqueViolation(err) {
+		// Uniqueness is left to the index, a check before the insert would race.
+		taken := &ValidationErrors{}
+		taken.Add("username", "taken", "Username already exists")
+		WriteValidationErrors(w, http.StatusConflict, taken)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	err = SendVerificationMail(req.Context(), userId, user.Username, user.Email)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Failed to send verification mail", "user", user.Username, "error", err)
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
 func LoginUser(w http.ResponseWriter, req *http.Request) {
-	body := make([]byte, req.ContentLength)
-	_, err := req.Body.Read(body)
-	defer req.Body.Close()
-	if err != io.EOF {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	user := User{}
+	if !DecodeJSON(w, req, &user) {
 		return
 	}
 
-	user := User{}
-	err = json.Unmarshal(body, &user)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	attempt := NewLoginAttempt(req, "user:"+strings.ToLower(user.Username))
+	if !attempt.Allow(w, req) {
 		return
 	}
 
 	var dbUser User
-    err = db.QueryRow("SELECT username, password FROM users WHERE username=$1",
-		user.Username).Scan(&dbUser.Username, &dbUser.Password)
+	var userId uint64
+	var role Role
+	var banned bool
+	var totpEnabled bool
+	err := database.Retry(req.Context(), func() error {
+		return db.QueryRowContext(req.Context(), "SELECT id, username, password, role, banned, totpEnabled FROM users WHERE lower(username)=lower($1) AND deletedAt IS NULL",
+			user.Username).Scan(&userId, &dbUser.Username, &dbUser.Password, &role, &banned, &totpEnabled)
+	})
     if err != nil {
+		attempt.Fail(req)
         http.Error(w, "Incorrect username or password", http.StatusForbidden)
         return
     }
 
-	if dbUser.Password != HashPassword(user.Username, user.Password) {
+	// Usernames are case-insensitive, the password is hashed with the stored
+	// spelling.
+	if dbUser.Password != HashPassword(dbUser.Username, user.Password) {
+		attempt.Fail(req)
 		http.Error(w, "Incorrect username or password", http.StatusForbidden)
 		return
 	}
+	attempt.Succeed(req)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"username": user.Username,
-	})
+	if banned {
+		http.Error(w, "User is banned", http.StatusForbidden)
+		return
+	}
+
+	if totpEnabled {
+		mfaToken, err := SignToken(PurposeMFA, jwt.MapClaims{
+			"uid": userId,
+			"exp": time.Now().Add(mfaTokenTTL).Unix(),
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error signing token: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(MFAChallenge{
+			MFARequired: true,
+			MFAToken:    mfaToken,
+		})
+		return
+	}
 
-	tokenString, err := token.SignedString(privateKey)
+	IssueAccessToken(w, userId, dbUser.Username, role)
+}
+
+func IssueAccessToken(w http.ResponseWriter, userId uint64, username string, role Role) {
+	sessionId, err := CreateSession(userId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tokenString, err := SignToken(PurposeAccess, jwt.MapClaims{
+		"username": username,
+		"role":     role,
+		"sid":      sessionId,
+	})
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error signing token: %s", err.Error()), http.StatusInternalServerError)
 		return
@@ -111,40 +165,91 @@ func LoginUser(w http.ResponseWriter, req *http.Request) {
 }
 
 func UpdateUser(w http.ResponseWriter, req *http.Request) {
-	username, err := Authenticate(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return
-    }
+	principal := CurrentPrincipal(req)
 
-	body := make([]byte, req.ContentLength)
-	_, err = req.Body.Read(body)
-	defer req.Body.Close()
-	if err != io.EOF {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	userInfo := UserInfo{}
+	if !DecodeJSON(w, req, &userInfo) {
 		return
 	}
 
-	userInfo := UserInfo{}
-	err = json.Unmarshal(body, &userInfo)
+	if userInfo.Mail != "" {
+		err := ValidateEmail(userInfo.Mail)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var currentMail string
+	err := db.QueryRow("SELECT COALESCE(mail, '') FROM users WHERE id=$1", principal.Id).Scan(&currentMail)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
+	mailChanged := currentMail != userInfo.Mail
 
-	var dbUsername string
-    err = db.QueryRow("SELECT username FROM users WHERE username=$1", username).Scan(&dbUsername)
-    if err != nil {
-        http.Error(w, "User not found", http.StatusNotFound)
-        return
-    }
-
-	_, err = db.Exec("UPDATE users SET firstname=$1, lastname=$2, dateofbirth=$3, mail=$4, phone=$5 WHERE username=$6",
-		userInfo.FirstName, userInfo.LastName, userInfo.DateOfBirth, userInfo.Mail, userInfo.Phone, username)
+	_, err = db.Exec(`
+		UPDATE users SET firstname=$1, lastname=$2, dateofbirth=$3, mail=$4, phone=$5, mailVerified=mailVerified AND NOT $6
+		WHERE username=$7
+	`, userInfo.FirstName, userInfo.LastName, userInfo.DateOfBirth, userInfo.Mail, userInfo.Phone, mailChanged, principal.Username)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to update user: %s", err.Error()), http.StatusBadRequest)
 		return
 	}
 
+	if mailChanged {
+		userCache.Invalidate(principal.Username)
+		if userInfo.Mail != "" {
+			err = SendVerificationMail(req.Context(), principal.Id, principal.Username, userInfo.Mail)
+			if err != nil {
+				slog.ErrorContext(req.Context(), "Failed to send verification mail", "user", principal.Username, "error", err)
+			}
+		}
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
+
+func DeleteAccount(w http.ResponseWriter, req *http.Request) {
+	principal := CurrentPrincipal(req)
+
+	err := database.RunInTx(req.Context(), db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(req.Context(), "UPDATE users SET deletedAt=now() WHERE id=$1 AND deletedAt IS NULL", principal.Id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(req.Context(), "DELETE FROM follows WHERE followerId=$1 OR followeeId=$1", principal.Id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(req.Context(), "INSERT INTO accountDeletions(userId, username) VALUES($1, $2)", principal.Id, principal.Username)
+		return err
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete user: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	userCache.Invalidate(principal.Username)
+
+	// The user is already gone for authentication, and pending deletions are
+	// retried in the background, so failures below do not fail the request.
+	err = RevokeSessions(principal.Id, "")
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Failed to revoke sessions", "user", principal.Username, "error", err)
+	}
+
+	err = PublishUserDeleted(req.Context(), principal.Username)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Failed to publish account deletion", "user", principal.Username, "error", err)
+	}
+
+	err = DeleteUserExports(req.Context(), principal.Id)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Failed to delete exports", "user", principal.Username, "error", err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
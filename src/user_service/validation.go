@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+	minPasswordLength = 8
+	maxPasswordLength = 128
+)
+
+// Usernames are plain ASCII so they look the same everywhere and cannot be
+// spoofed with lookalike characters. They start and end with a letter or
+// a digit.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9](?:[A-Za-z0-9_.-]*[A-Za-z0-9])?$`)
+
+var reservedUsernames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"anonymous":     true,
+	"api":           true,
+	"deleted":       true,
+	"me":            true,
+	"moderator":     true,
+	"null":          true,
+	"root":          true,
+	"support":       true,
+	"system":        true,
+}
+
+var commonPasswords = map[string]bool{
+	"password":    true,
+	"password1":   true,
+	"password123": true,
+	"12345678":    true,
+	"123456789":   true,
+	"1234567890":  true,
+	"qwerty123":   true,
+	"qwertyuiop":  true,
+	"iloveyou1":   true,
+	"letmein1":    true,
+	"welcome1":    true,
+	"abc12345":    true,
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects every problem of a request, so clients can show
+// them all at once.
+type ValidationErrors struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (v *ValidationErrors) Add(field string, code string, message string) {
+	v.Errors = append(v.Errors, FieldError{
+		Field:   field,
+		Code:    code,
+		Message: message,
+	})
+}
+
+func (v *ValidationErrors) Empty() bool {
+	return len(v.Errors) == 0
+}
+
+func (v *ValidationErrors) Error() string {
+	messages := make([]string, len(v.Errors))
+	for i, fieldError := range v.Errors {
+		messages[i] = fmt.Sprintf("%s: %s", fieldError.Field, fieldError.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+func WriteValidationErrors(w http.ResponseWriter, status int, v *ValidationErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// WriteError writes validation errors as JSON and anything else as text.
+func WriteError(w http.ResponseWriter, err error, status int) {
+	var v *ValidationErrors
+	if errors.As(err, &v) {
+		WriteValidationErrors(w, http.StatusBadRequest, v)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func ValidateUsername(v *ValidationErrors, username string) {
+	length := utf8.RuneCountInString(username)
+	switch {
+	case length < minUsernameLength:
+		v.Add("username", "too_short", fmt.Sprintf("Username must be at least %d characters long", minUsernameLength))
+	case length > maxUsernameLength:
+		v.Add("username", "too_long", fmt.Sprintf("Username must be at most %d characters long", maxUsernameLength))
+	case !usernamePattern.MatchString(username):
+		v.Add("username", "invalid_characters",
+			"Username may contain only latin letters, digits, '_', '.' and '-', and must start and end with a letter or a digit")
+	case reservedUsernames[strings.ToLower(username)]:
+		v.Add("username", "reserved", "Username is reserved")
+	}
+}
+
+// ValidatePassword checks the password policy. The username may be empty
+// when it is not known yet.
+func ValidatePassword(v *ValidationErrors, field string, username string, password string) {
+	length := utf8.RuneCountInString(password)
+	if length < minPasswordLength {
+		v.Add(field, "too_short", fmt.Sprintf("Password must be at least %d characters long", minPasswordLength))
+		return
+	}
+	if length > maxPasswordLength {
+		v.Add(field, "too_long", fmt.Sprintf("Password must be at most %d characters long", maxPasswordLength))
+		return
+	}
+
+	var letter, other bool
+	for _, c := range password {
+		if unicode.IsLetter(c) {
+			letter = true
+		} else {
+			other = true
+		}
+	}
+	if !letter || !other {
+		v.Add(field, "too_weak", "Password must contain letters and at least one digit or symbol")
+		return
+	}
+
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		v.Add(field, "too_common", "Password is too common")
+		return
+	}
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		v.Add(field, "contains_username", "Password must not contain the username")
+	}
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const PurposeVerifyEmail = "verify-email"
+
+var emailVerificationTTL time.Duration
+var requireVerifiedEmail bool
+
+func ValidateEmail(address string) error {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address {
+		return errors.New("Invalid email address")
+	}
+	return nil
+}
+
+// SendVerificationMail sends a signed link that confirms the given address.
+// The link stops working once the user changes the address.
+func SendVerificationMail(ctx context.Context, userId uint64, username string, address string) error {
+	token, err := SignToken(PurposeVerifyEmail, jwt.MapClaims{
+		"uid":  userId,
+		"mail": address,
+		"exp":  time.Now().Add(emailVerificationTTL).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/user/verify?token=%s", publicURL, url.QueryEscape(token))
+	return mailer.Send(ctx, Mail{
+		To:      address,
+		Subject: "Confirm your email",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen this link within %s to confirm your email address:\n\n%s\n",
+			username, emailVerificationTTL, link),
+	})
+}
+
+func VerifyEmail(w http.ResponseWriter, req *http.Request) {
+	claims, err := ParseToken(req.URL.Query().Get("token"), PurposeVerifyEmail)
+	if err != nil {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+	userId, ok := claims["uid"].(float64)
+	if !ok {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+	address, ok := claims["mail"].(string)
+	if !ok {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+
+	var username string
+	err = db.QueryRow("UPDATE users SET mailVerified=TRUE WHERE id=$1 AND mail=$2 AND deletedAt IS NULL RETURNING username",
+		uint64(userId), address).Scan(&username)
+	if err != nil {
+		http.Error(w, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+
+	userCache.Invalidate(username)
+	w.WriteHeader(http.StatusOK)
+}
+
+func ResendVerification(w http.ResponseWriter, req *http.Request) {
+	principal := CurrentPrincipal(req)
+
+	var address string
+	var verified bool
+	err := db.QueryRow("SELECT COALESCE(mail, ''), mailVerified FROM users WHERE id=$1", principal.Id).
+		Scan(&address, &verified)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if address == "" {
+		http.Error(w, "No email address", http.StatusBadRequest)
+		return
+	}
+	if verified {
+		http.Error(w, "Email already verified", http.StatusConflict)
+		return
+	}
+
+	err = SendVerificationMail(req.Context(), principal.Id, principal.Username, address)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to send mail: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// RequireVerifiedEmail blocks the request when the policy demands a
+// verified email. It must be used after RequireAuth.
+func RequireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if requireVerifiedEmail && !CurrentPrincipal(req).MailVerified {
+			http.Error(w, "Email is not verified", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}